@@ -30,40 +30,75 @@ import (
 
 var (
 	endID = uint64(math.MaxUint64)
+
+	// legacyClusterIDReserved are the pdClusterRootPath children that are
+	// never a cluster ID, so legacyClusterID skips them while scanning.
+	legacyClusterIDReserved = map[string]bool{"id": true, "leader": true, "migrate": true}
 )
 
-// GetCurrentClusterMembers returns members in current etcd cluster
+// GetCurrentClusterMembers returns members in current etcd cluster. It is
+// only meaningful for the etcdv3 backend; other backends return an error.
 func (s *Store) GetCurrentClusterMembers() (*clientv3.MemberListResponse, error) {
-	ctx, cancel := context.WithTimeout(s.client.Ctx(), DefaultRequestTimeout)
-	members, err := s.client.MemberList(ctx)
-	cancel()
+	kv, ok := s.kv.(*etcdv3KV)
+	if !ok {
+		return nil, errors.Errorf("storage: %s backend has no etcd cluster members", s.cfg.Backend)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultRequestTimeout)
+	defer cancel()
 
-	return members, errors.Wrap(err, "")
+	return kv.Members(ctx)
 }
 
-// GetClusterID returns current cluster id
+// GetClusterID returns current cluster id.
 // if cluster is not init, return 0
 func (s *Store) GetClusterID() (uint64, error) {
-	resp, err := s.get(pdClusterIDPath, clientv3.WithFirstCreate()...)
-
-	if len(resp.Kvs) == 0 {
+	data, err := s.getValue(pdClusterIDPath)
+	if err != nil {
 		return 0, err
 	}
 
-	key := string(resp.Kvs[0].Key)
+	if data != nil {
+		return util.BytesToUint64(data)
+	}
+
+	// compatibility: a cluster bootstrapped before pdClusterIDPath existed
+	// never wrote it, so fall back to parsing the ID out of whichever other
+	// key under pdClusterRootPath turns up first - every one of them is
+	// rooted at "pdClusterRootPath/<clusterID>".
+	return s.legacyClusterID()
+}
 
-	// If the key is "pdClusterIDPath", parse the cluster ID from it.
-	if key == pdClusterIDPath {
-		return util.BytesToUint64(resp.Kvs[0].Value)
+// legacyClusterID scans pdClusterRootPath for the first key belonging to a
+// cluster bootstrapped before pdClusterIDPath existed, and parses the
+// cluster ID out of its first path segment.
+func (s *Store) legacyClusterID() (uint64, error) {
+	prefix := pdClusterRootPath + "/"
+
+	kvs, err := s.list(prefix, prefixRangeEnd(prefix), 0)
+	if err != nil {
+		return 0, err
 	}
 
-	// Parse the cluster ID from any other keys for compatibility.
-	elems := strings.Split(key, "/")
-	if len(elems) < 4 {
-		return 0, errors.Errorf("invalid cluster key %v", key)
+	for _, item := range kvs {
+		segment := strings.TrimPrefix(item.Key, prefix)
+		if idx := strings.IndexByte(segment, '/'); idx >= 0 {
+			segment = segment[:idx]
+		}
+
+		if legacyClusterIDReserved[segment] {
+			continue
+		}
+
+		clusterID, err := strconv.ParseUint(segment, 10, 64)
+		if err != nil {
+			continue
+		}
+
+		return clusterID, nil
 	}
 
-	return strconv.ParseUint(elems[3], 10, 64)
+	return 0, nil
 }
 
 // CreateFirstClusterID create the first cluster
@@ -71,7 +106,7 @@ func (s *Store) GetClusterID() (uint64, error) {
 // only one can succ,
 // others will get the committed id.
 func (s *Store) CreateFirstClusterID() (uint64, error) {
-	ctx, cancel := context.WithTimeout(s.client.Ctx(), DefaultTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultTimeout)
 	defer cancel()
 
 	// Generate a random cluster ID.
@@ -79,10 +114,10 @@ func (s *Store) CreateFirstClusterID() (uint64, error) {
 	clusterID := (ts << 32) + uint64(rand.Uint32())
 	value := util.Uint64ToBytes(clusterID)
 
-	resp, err := s.client.Txn(ctx).
-		If(clientv3.Compare(clientv3.CreateRevision(pdClusterIDPath), "=", 0)).
-		Then(clientv3.OpPut(pdClusterIDPath, string(value))).
-		Else(clientv3.OpGet(pdClusterIDPath)).
+	resp, err := s.kv.Txn(ctx).
+		If(Cmp{Key: pdClusterIDPath, Target: CmpCreateRevision, Result: "=", Value: int64(0)}).
+		Then(Op{Type: OpPut, Key: pdClusterIDPath, Value: s.encode(value)}).
+		Else(Op{Type: OpGet, Key: pdClusterIDPath}).
 		Commit()
 
 	if err != nil {
@@ -95,21 +130,21 @@ func (s *Store) CreateFirstClusterID() (uint64, error) {
 	}
 
 	// Otherwise, parse the committed cluster ID.
-	if len(resp.Responses) == 0 {
-		return 0, errors.Errorf("txn returns empty response: %v", resp)
+	if len(resp.Responses) == 0 || len(resp.Responses[0].Kvs) != 1 {
+		return 0, errors.Errorf("txn returns invalid response: %v", resp)
 	}
 
-	response := resp.Responses[0].GetResponseRange()
-	if response == nil || len(response.Kvs) != 1 {
-		return 0, errors.Errorf("txn returns invalid range response: %v", resp)
+	committed, err := s.decode(resp.Responses[0].Kvs[0].Value)
+	if err != nil {
+		return 0, err
 	}
 
-	return util.BytesToUint64(response.Kvs[0].Value)
+	return util.BytesToUint64(committed)
 }
 
 // SetClusterBootstrapped set cluster bootstrapped flag, only one can succ.
 func (s *Store) SetClusterBootstrapped(clusterID uint64, cluster metapb.Cluster, store metapb.Store, cell metapb.Cell) (bool, error) {
-	ctx, cancel := context.WithTimeout(s.client.Ctx(), DefaultTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultTimeout)
 	defer cancel()
 
 	clusterBaseKey := s.getClusterMetaKey(clusterID)
@@ -117,29 +152,29 @@ func (s *Store) SetClusterBootstrapped(clusterID uint64, cluster metapb.Cluster,
 	cellKey := s.getCellMetaKey(clusterID, cell.ID)
 
 	// build operations
-	var ops []clientv3.Op
+	var ops []Op
 
 	meta, err := cluster.Marshal()
 	if err != nil {
 		return false, errors.Wrap(err, "")
 	}
-	ops = append(ops, clientv3.OpPut(clusterBaseKey, string(meta)))
+	ops = append(ops, Op{Type: OpPut, Key: clusterBaseKey, Value: s.encode(meta)})
 
 	meta, err = store.Marshal()
 	if err != nil {
 		return false, errors.Wrap(err, "")
 	}
-	ops = append(ops, clientv3.OpPut(storeKey, string(meta)))
+	ops = append(ops, Op{Type: OpPut, Key: storeKey, Value: s.encode(meta)})
 
 	meta, err = cell.Marshal()
 	if err != nil {
 		return false, errors.Wrap(err, "")
 	}
-	ops = append(ops, clientv3.OpPut(cellKey, string(meta)))
+	ops = append(ops, Op{Type: OpPut, Key: cellKey, Value: s.encode(meta)})
 
 	// txn
-	resp, err := s.client.Txn(ctx).
-		If(clientv3.Compare(clientv3.CreateRevision(clusterBaseKey), "=", 0)).
+	resp, err := s.kv.Txn(ctx).
+		If(Cmp{Key: clusterBaseKey, Target: CmpCreateRevision, Result: "=", Value: int64(0)}).
 		Then(ops...).
 		Commit()
 
@@ -177,18 +212,16 @@ func (s *Store) LoadClusterMeta(clusterID uint64) (*metapb.Cluster, error) {
 // do funcation will call on each loaded store meta info
 func (s *Store) LoadStoreMeta(clusterID uint64, limit int64, do func(metapb.Store)) error {
 	startID := uint64(0)
-	endStore := s.getStoreMetaKey(clusterID, endID)
-	withRange := clientv3.WithRange(endStore)
-	withLimit := clientv3.WithLimit(limit)
+	endStoreKey := s.getStoreMetaKey(clusterID, endID)
 
 	for {
 		startKey := s.getStoreMetaKey(clusterID, startID)
-		resp, err := s.get(startKey, withRange, withLimit)
+		kvs, err := s.list(startKey, endStoreKey, limit)
 		if err != nil {
 			return err
 		}
 
-		for _, item := range resp.Kvs {
+		for _, item := range kvs {
 			v := &metapb.Store{}
 			err := v.Unmarshal(item.Value)
 			if err != nil {
@@ -200,7 +233,7 @@ func (s *Store) LoadStoreMeta(clusterID uint64, limit int64, do func(metapb.Stor
 		}
 
 		// read complete
-		if len(resp.Kvs) < int(limit) {
+		if int64(len(kvs)) < limit {
 			break
 		}
 	}
@@ -213,17 +246,15 @@ func (s *Store) LoadStoreMeta(clusterID uint64, limit int64, do func(metapb.Stor
 func (s *Store) LoadCellMeta(clusterID uint64, limit int64, do func(metapb.Cell)) error {
 	startID := uint64(0)
 	endCellKey := s.getCellMetaKey(clusterID, endID)
-	withRange := clientv3.WithRange(endCellKey)
-	withLimit := clientv3.WithLimit(limit)
 
 	for {
 		startKey := s.getCellMetaKey(clusterID, startID)
-		resp, err := s.get(startKey, withRange, withLimit)
+		kvs, err := s.list(startKey, endCellKey, limit)
 		if err != nil {
 			return err
 		}
 
-		for _, item := range resp.Kvs {
+		for _, item := range kvs {
 			v := &metapb.Cell{}
 			err := v.Unmarshal(item.Value)
 
@@ -236,7 +267,7 @@ func (s *Store) LoadCellMeta(clusterID uint64, limit int64, do func(metapb.Cell)
 		}
 
 		// read complete
-		if len(resp.Kvs) < int(limit) {
+		if int64(len(kvs)) < limit {
 			break
 		}
 	}
@@ -252,7 +283,7 @@ func (s *Store) SetStoreMeta(clusterID uint64, store metapb.Store) error {
 		return errors.Wrap(err, "")
 	}
 
-	return s.save(key, string(meta))
+	return s.save(key, meta)
 }
 
 // SetCellMeta returns nil if cell is add or update succ
@@ -263,7 +294,7 @@ func (s *Store) SetCellMeta(clusterID uint64, cell metapb.Cell) error {
 		return errors.Wrap(err, "")
 	}
 
-	return s.save(cellKey, string(meta))
+	return s.save(cellKey, meta)
 }
 
 func (s *Store) getClusterMetaKey(clusterID uint64) string {
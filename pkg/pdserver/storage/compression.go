@@ -0,0 +1,118 @@
+// Copyright 2016 DeepFabric, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+
+	"github.com/golang/snappy"
+	"github.com/pkg/errors"
+)
+
+// Compression selects the codec Store uses for values at or above
+// CompressionMinBytes before writing them to the backend.
+type Compression string
+
+const (
+	// CompressionNone stores values as-is.
+	CompressionNone Compression = "none"
+	// CompressionGzip gzips values.
+	CompressionGzip Compression = "gzip"
+	// CompressionSnappy compresses values with snappy.
+	CompressionSnappy Compression = "snappy"
+)
+
+// DefaultCompressionMinBytes is used when a Cfg enables compression but
+// does not set CompressionMinBytes.
+const DefaultCompressionMinBytes = 4096
+
+// Every value this Store writes carries a one-byte magic prefix so decode
+// can tell new-format values (compressed or explicitly stored raw) apart
+// from legacy values written before this codec existed, which carry no
+// prefix at all. The magic bytes are chosen in the 0xf0-0xff range: a
+// metapb.Store/metapb.Cell protobuf always begins with a small field tag
+// (e.g. 0x0a for field 1, wire type 2), so a legacy value can never
+// collide with one of these.
+const (
+	compressionMagicNone   byte = 0xf1
+	compressionMagicGzip   byte = 0xf2
+	compressionMagicSnappy byte = 0xf3
+)
+
+// encode tags v with the Store's compression magic byte, compressing it
+// first when it is configured to and v is at least compressionMinBytes.
+func (s *Store) encode(v []byte) []byte {
+	if s.compression == CompressionNone || s.compression == "" || len(v) < s.compressionMinBytes {
+		return append([]byte{compressionMagicNone}, v...)
+	}
+
+	switch s.compression {
+	case CompressionGzip:
+		var buf bytes.Buffer
+		buf.WriteByte(compressionMagicGzip)
+		w := gzip.NewWriter(&buf)
+		w.Write(v)
+		w.Close()
+		return buf.Bytes()
+	case CompressionSnappy:
+		return append([]byte{compressionMagicSnappy}, snappy.Encode(nil, v)...)
+	default:
+		return append([]byte{compressionMagicNone}, v...)
+	}
+}
+
+// decode strips v's magic byte and decompresses it if needed. A value with
+// no recognized magic byte is a legacy value written before this codec
+// existed, and is returned unchanged.
+func (s *Store) decode(v []byte) ([]byte, error) {
+	if len(v) == 0 {
+		return v, nil
+	}
+
+	switch v[0] {
+	case compressionMagicNone:
+		return v[1:], nil
+	case compressionMagicGzip:
+		r, err := gzip.NewReader(bytes.NewReader(v[1:]))
+		if err != nil {
+			return nil, errors.Wrap(err, "")
+		}
+		defer r.Close()
+
+		data, err := ioutil.ReadAll(r)
+		return data, errors.Wrap(err, "")
+	case compressionMagicSnappy:
+		data, err := snappy.Decode(nil, v[1:])
+		return data, errors.Wrap(err, "")
+	default:
+		return v, nil
+	}
+}
+
+// isLegacyValue reports whether v was written before Store tagged values
+// with a compression magic byte.
+func isLegacyValue(v []byte) bool {
+	if len(v) == 0 {
+		return false
+	}
+
+	switch v[0] {
+	case compressionMagicNone, compressionMagicGzip, compressionMagicSnappy:
+		return false
+	default:
+		return true
+	}
+}
@@ -0,0 +1,443 @@
+// Copyright 2016 DeepFabric, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/pkg/errors"
+)
+
+// consulSessionTTL is the TTL Consul attaches to the native session backing
+// a consulElection's leadership.
+const consulSessionTTL = "10s"
+
+// consulCampaignRetryInterval is how often a blocked Campaign retries
+// acquiring rootPath, to match etcdv3Election's blocking campaign
+// semantics.
+const consulCampaignRetryInterval = 500 * time.Millisecond
+
+// consulKV is the KVStore driver backed by Consul's KV store. Consul has no
+// MVCC revisions; a Txn compares either a value (CmpValue) or, for any other
+// target, only whether the key exists (a CAS against ModifyIndex 0), and
+// Watch is implemented with blocking queries keyed on the ModifyIndex.
+type consulKV struct {
+	client *api.Client
+}
+
+func newConsulKV(endpoints []string) (KVStore, error) {
+	cfg := api.DefaultConfig()
+	if len(endpoints) > 0 {
+		cfg.Address = endpoints[0]
+	}
+
+	client, err := api.NewClient(cfg)
+	if err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+
+	return &consulKV{client: client}, nil
+}
+
+func (kv *consulKV) Get(ctx context.Context, key string) ([]byte, error) {
+	pair, _, err := kv.client.KV().Get(key, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+
+	if pair == nil {
+		return nil, nil
+	}
+
+	return pair.Value, nil
+}
+
+func (kv *consulKV) List(ctx context.Context, key, rangeEnd string, limit int64) ([]KV, error) {
+	kvs, _, err := kv.ListWithRev(ctx, key, rangeEnd, limit)
+	return kvs, err
+}
+
+// ListWithRev uses the query metadata's LastIndex as the revision: Consul's
+// blocking queries resume from an index the same way a Watch resumes from
+// a revision elsewhere.
+//
+// Consul's KV().List does a literal byte-prefix match, and key is usually a
+// single padded leaf (e.g. ".../stores/%020d") that nothing else shares a
+// prefix with - so this lists key's shared parent prefix instead and
+// filters the results client-side down to [key, rangeEnd), the same way
+// rangeEnd is already filtered.
+func (kv *consulKV) ListWithRev(ctx context.Context, key, rangeEnd string, limit int64) ([]KV, int64, error) {
+	pairs, meta, err := kv.client.KV().List(dirPrefix(key), nil)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "")
+	}
+
+	var kvs []KV
+	for _, p := range pairs {
+		if p.Key < key || (rangeEnd != "" && p.Key >= rangeEnd) {
+			continue
+		}
+		kvs = append(kvs, KV{Key: p.Key, Value: p.Value})
+		if limit > 0 && int64(len(kvs)) >= limit {
+			break
+		}
+	}
+
+	return kvs, int64(meta.LastIndex), nil
+}
+
+func (kv *consulKV) Put(ctx context.Context, key string, value []byte) error {
+	_, err := kv.client.KV().Put(&api.KVPair{Key: key, Value: value}, nil)
+	return errors.Wrap(err, "")
+}
+
+func (kv *consulKV) Delete(ctx context.Context, key string) error {
+	_, err := kv.client.KV().Delete(key, nil)
+	return errors.Wrap(err, "")
+}
+
+func (kv *consulKV) Txn(ctx context.Context) Txn {
+	return &consulTxn{client: kv.client}
+}
+
+func (kv *consulKV) Watch(ctx context.Context, key, rangeEnd string, fromRev int64) (<-chan WatchEvent, CancelFunc, error) {
+	out := make(chan WatchEvent)
+	done := make(chan struct{})
+
+	go func() {
+		defer close(out)
+
+		waitIndex := uint64(fromRev)
+		seen := map[string][]byte{}
+		// fromRev <= 0 means watch from now: the first query returns at once
+		// and only seeds seen, so keys that already exist are not reported.
+		primed := fromRev > 0
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ctx.Done():
+				return
+			default:
+			}
+
+			// listed and filtered to [key, rangeEnd) the same way as ListWithRev.
+			pairs, meta, err := kv.client.KV().List(dirPrefix(key), (&api.QueryOptions{WaitIndex: waitIndex}).WithContext(ctx))
+			if err != nil {
+				return
+			}
+
+			waitIndex = meta.LastIndex
+
+			current := map[string][]byte{}
+			for _, p := range pairs {
+				if p.Key < key || (rangeEnd != "" && p.Key >= rangeEnd) {
+					continue
+				}
+				current[p.Key] = p.Value
+				if !primed {
+					continue
+				}
+				if old, ok := seen[p.Key]; !ok || string(old) != string(p.Value) {
+					out <- WatchEvent{Type: EventTypePut, KV: KV{Key: p.Key, Value: p.Value}, Rev: int64(meta.LastIndex)}
+				}
+			}
+
+			if primed {
+				for k := range seen {
+					if _, ok := current[k]; !ok {
+						out <- WatchEvent{Type: EventTypeDelete, KV: KV{Key: k}, Rev: int64(meta.LastIndex)}
+					}
+				}
+			}
+
+			seen = current
+			primed = true
+		}
+	}()
+
+	cancel := func() { close(done) }
+	return out, cancel, nil
+}
+
+func (kv *consulKV) Close() error {
+	return nil
+}
+
+// consulTxn only supports the two compare-and-swap shapes the storage
+// package actually issues: "create key if it does not yet exist" and
+// "replace key if its value still matches what was last read". Both are
+// built on Consul's KV.Txn with a CAS verb, the former against ModifyIndex
+// 0 and the latter against the index observed for that value.
+type consulTxn struct {
+	client *api.Client
+	cmps   []Cmp
+	thenOp []Op
+	elseOp []Op
+}
+
+func (t *consulTxn) If(cmps ...Cmp) Txn {
+	t.cmps = cmps
+	return t
+}
+
+func (t *consulTxn) Then(ops ...Op) Txn {
+	t.thenOp = ops
+	return t
+}
+
+func (t *consulTxn) Else(ops ...Op) Txn {
+	t.elseOp = ops
+	return t
+}
+
+func (t *consulTxn) Commit() (*TxnResponse, error) {
+	if len(t.cmps) != 1 || len(t.thenOp) != 1 || t.thenOp[0].Type != OpPut {
+		return nil, errors.Errorf("storage: consul only supports single-key create-if-absent or value-CAS transactions")
+	}
+
+	cmp := t.cmps[0]
+	key := cmp.Key
+
+	var index uint64
+	if cmp.Target == CmpValue {
+		prevValue, _ := cmp.Value.(string)
+
+		pair, _, err := t.client.KV().Get(key, nil)
+		if err != nil {
+			return nil, errors.Wrap(err, "")
+		}
+		if pair == nil || string(pair.Value) != prevValue {
+			return t.readBack()
+		}
+		index = pair.ModifyIndex
+	}
+
+	ops := api.KVTxnOps{
+		&api.KVTxnOp{Verb: api.KVCAS, Key: key, Value: t.thenOp[0].Value, Index: index},
+	}
+
+	ok, resp, _, err := t.client.KV().Txn(ops, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+
+	if ok {
+		return &TxnResponse{Succeeded: true}, nil
+	}
+
+	// resp.Errors explains why the CAS lost; this is expected when another
+	// PD already bootstrapped the cluster or another writer beat a
+	// read-modify-write, so it is not surfaced as an error, only folded into
+	// the read-back below.
+	_ = resp
+
+	return t.readBack()
+}
+
+func (t *consulTxn) readBack() (*TxnResponse, error) {
+	txnResp := &TxnResponse{Succeeded: false}
+	for _, op := range t.elseOp {
+		if op.Type != OpGet {
+			continue
+		}
+		pair, _, err := t.client.KV().Get(op.Key, nil)
+		if err != nil {
+			return nil, errors.Wrap(err, "")
+		}
+		if pair != nil {
+			txnResp.Responses = append(txnResp.Responses, OpResponse{Kvs: []KV{{Key: op.Key, Value: pair.Value}}})
+		}
+	}
+
+	return txnResp, nil
+}
+
+// consulSession wraps a native Consul session, renewed periodically until
+// Close, whose expiry (missed renewal, agent restart) closes Done.
+type consulSession struct {
+	id   string
+	done chan struct{}
+	stop chan struct{}
+}
+
+func (s *consulSession) Done() <-chan struct{} {
+	return s.done
+}
+
+func (s *consulSession) Close() error {
+	close(s.stop)
+	return nil
+}
+
+// consulElection implements leader election on Consul's native sessions:
+// Campaign retries Acquire on rootPath until it succeeds - which only
+// happens while no other session holds it - or until ctx is done, and
+// Resign releases it. This is the one backend here whose session concept
+// (TTL-bound, server-managed) was a first-class primitive already, rather
+// than something built out of a plain KV entry.
+type consulElection struct {
+	client   *api.Client
+	rootPath string
+
+	mu      sync.Mutex
+	session *consulSession
+}
+
+func newConsulElection(endpoints []string, rootPath string) (Election, error) {
+	cfg := api.DefaultConfig()
+	if len(endpoints) > 0 {
+		cfg.Address = endpoints[0]
+	}
+
+	client, err := api.NewClient(cfg)
+	if err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+
+	return &consulElection{client: client, rootPath: rootPath}, nil
+}
+
+// ensureSession returns the current Session, creating a fresh native
+// Consul session if there is none yet or the previous one expired.
+func (e *consulElection) ensureSession() (*consulSession, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.session != nil {
+		select {
+		case <-e.session.Done():
+			// session expired: fall through and create a fresh one.
+		default:
+			return e.session, nil
+		}
+	}
+
+	id, _, err := e.client.Session().Create(&api.SessionEntry{
+		TTL:      consulSessionTTL,
+		Behavior: api.SessionBehaviorRelease,
+	}, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+
+	s := &consulSession{id: id, done: make(chan struct{}), stop: make(chan struct{})}
+	go func() {
+		defer close(s.done)
+		e.client.Session().RenewPeriodic(consulSessionTTL, id, nil, s.stop)
+	}()
+
+	e.session = s
+
+	return s, nil
+}
+
+func (e *consulElection) Campaign(ctx context.Context, leaderID string) error {
+	ticker := time.NewTicker(consulCampaignRetryInterval)
+	defer ticker.Stop()
+
+	for {
+		session, err := e.ensureSession()
+		if err != nil {
+			return err
+		}
+
+		acquired, _, err := e.client.KV().Acquire(&api.KVPair{
+			Key:     e.rootPath,
+			Value:   []byte(leaderID),
+			Session: session.id,
+		}, nil)
+		if err != nil {
+			return errors.Wrap(err, "")
+		}
+
+		if acquired {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return errors.Wrap(ctx.Err(), "")
+		case <-ticker.C:
+		}
+	}
+}
+
+func (e *consulElection) Resign(ctx context.Context) error {
+	e.mu.Lock()
+	session := e.session
+	e.mu.Unlock()
+
+	if session == nil {
+		return nil
+	}
+
+	_, _, err := e.client.KV().Release(&api.KVPair{Key: e.rootPath, Session: session.id}, nil)
+	return errors.Wrap(err, "")
+}
+
+func (e *consulElection) Leader(ctx context.Context) (string, int64, error) {
+	pair, _, err := e.client.KV().Get(e.rootPath, nil)
+	if err != nil {
+		return "", 0, errors.Wrap(err, "")
+	}
+
+	if pair == nil || pair.Session == "" {
+		return "", 0, nil
+	}
+
+	return string(pair.Value), int64(pair.ModifyIndex), nil
+}
+
+func (e *consulElection) Observe(ctx context.Context) <-chan LeaderEvent {
+	out := make(chan LeaderEvent)
+
+	go func() {
+		defer close(out)
+
+		waitIndex := uint64(0)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			default:
+			}
+
+			pair, meta, err := e.client.KV().Get(e.rootPath, (&api.QueryOptions{WaitIndex: waitIndex}).WithContext(ctx))
+			if err != nil {
+				return
+			}
+
+			waitIndex = meta.LastIndex
+			if pair != nil && pair.Session != "" {
+				out <- LeaderEvent{LeaderID: string(pair.Value), Rev: int64(pair.ModifyIndex)}
+			}
+		}
+	}()
+
+	return out
+}
+
+func (e *consulElection) Session() Session {
+	session, err := e.ensureSession()
+	if err != nil {
+		return nil
+	}
+
+	return session
+}
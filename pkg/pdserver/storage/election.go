@@ -0,0 +1,43 @@
+// Copyright 2016 DeepFabric, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import "context"
+
+// Campaign blocks until leaderID becomes the PD leader, or ctx is done.
+func (s *Store) Campaign(ctx context.Context, leaderID string) error {
+	return s.election.Campaign(ctx, leaderID)
+}
+
+// Resign gives up PD leadership, if currently held.
+func (s *Store) Resign(ctx context.Context) error {
+	return s.election.Resign(ctx)
+}
+
+// Leader returns the current PD leader id and the revision it was elected
+// at, or ("", 0, nil) if there is no leader yet.
+func (s *Store) Leader(ctx context.Context) (string, int64, error) {
+	return s.election.Leader(ctx)
+}
+
+// Observe streams PD leadership changes until ctx is done.
+func (s *Store) Observe(ctx context.Context) <-chan LeaderEvent {
+	return s.election.Observe(ctx)
+}
+
+// ElectionSession returns the Session backing the Store's current
+// leadership lease, creating one on first call.
+func (s *Store) ElectionSession() Session {
+	return s.election.Session()
+}
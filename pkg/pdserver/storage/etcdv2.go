@@ -0,0 +1,447 @@
+// Copyright 2016 DeepFabric, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	etcd "github.com/coreos/go-etcd/etcd"
+	"github.com/pkg/errors"
+)
+
+// etcdv2SessionTTL is the TTL, in seconds, of the node an etcdv2Session
+// keeps alive. etcd v2 has no native lease, so the session is just a node
+// refreshed at half its TTL.
+const etcdv2SessionTTL = 10
+
+// etcdv2KV is the KVStore driver for clusters still running etcd v2. v2 has
+// no MVCC revisions, so a Txn compares either a value (CmpValue) or, for any
+// other target, only whether the key exists, and Watch events carry the raw
+// etcd index instead of a revision.
+type etcdv2KV struct {
+	client *etcd.Client
+}
+
+func newEtcdV2KV(endpoints []string) (KVStore, error) {
+	client := etcd.NewClient(endpoints)
+	if !client.SyncCluster() {
+		return nil, errors.Errorf("storage: failed to sync etcdv2 cluster %v", endpoints)
+	}
+
+	return &etcdv2KV{client: client}, nil
+}
+
+func (kv *etcdv2KV) Get(ctx context.Context, key string) ([]byte, error) {
+	resp, err := kv.client.Get(key, false, false)
+	if err != nil {
+		if isEtcdV2NotFound(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrap(err, "")
+	}
+
+	return []byte(resp.Node.Value), nil
+}
+
+func (kv *etcdv2KV) List(ctx context.Context, key, rangeEnd string, limit int64) ([]KV, error) {
+	kvs, _, err := kv.ListWithRev(ctx, key, rangeEnd, limit)
+	return kvs, err
+}
+
+// ListWithRev uses the response's EtcdIndex as the revision: v2 has no MVCC
+// revisions, but EtcdIndex is monotonic and a Watch can resume from it the
+// same way a v3 Watch resumes from a mod revision.
+//
+// key is usually a single padded leaf (e.g. ".../stores/%020d"), not a
+// directory node, so it cannot be Get'd recursively itself - instead this
+// lists key's parent directory and filters the children client-side down to
+// [key, rangeEnd), the same way etcdv3's WithRange does natively.
+func (kv *etcdv2KV) ListWithRev(ctx context.Context, key, rangeEnd string, limit int64) ([]KV, int64, error) {
+	dir := strings.TrimSuffix(dirPrefix(key), "/")
+	resp, err := kv.client.Get(dir, true, true)
+	if err != nil {
+		if isEtcdV2NotFound(err) {
+			return nil, 0, nil
+		}
+		return nil, 0, errors.Wrap(err, "")
+	}
+
+	var kvs []KV
+	for _, n := range resp.Node.Nodes {
+		if n.Dir || n.Key < key || (rangeEnd != "" && n.Key >= rangeEnd) {
+			continue
+		}
+		kvs = append(kvs, KV{Key: n.Key, Value: []byte(n.Value)})
+	}
+
+	sort.Slice(kvs, func(i, j int) bool { return kvs[i].Key < kvs[j].Key })
+	if limit > 0 && int64(len(kvs)) > limit {
+		kvs = kvs[:limit]
+	}
+
+	return kvs, int64(resp.EtcdIndex), nil
+}
+
+func (kv *etcdv2KV) Put(ctx context.Context, key string, value []byte) error {
+	_, err := kv.client.Set(key, string(value), 0)
+	return errors.Wrap(err, "")
+}
+
+func (kv *etcdv2KV) Delete(ctx context.Context, key string) error {
+	_, err := kv.client.Delete(key, false)
+	return errors.Wrap(err, "")
+}
+
+func (kv *etcdv2KV) Txn(ctx context.Context) Txn {
+	return &etcdv2Txn{client: kv.client}
+}
+
+func (kv *etcdv2KV) Watch(ctx context.Context, key, rangeEnd string, fromRev int64) (<-chan WatchEvent, CancelFunc, error) {
+	stop := make(chan bool)
+	out := make(chan WatchEvent)
+
+	// key is usually a padded leaf, so watch its parent directory and filter
+	// events down to [key, rangeEnd), as ListWithRev does.
+	dir := strings.TrimSuffix(dirPrefix(key), "/")
+	receiver := make(chan *etcd.Response)
+	go func() {
+		_, err := kv.client.Watch(dir, uint64(fromRev), true, receiver, stop)
+		if err != nil && err != etcd.ErrWatchStoppedByUser {
+			return
+		}
+	}()
+
+	go func() {
+		defer close(out)
+		for resp := range receiver {
+			if resp.Node.Key < key || (rangeEnd != "" && resp.Node.Key >= rangeEnd) {
+				continue
+			}
+			evt := WatchEvent{KV: KV{Key: resp.Node.Key, Value: []byte(resp.Node.Value)}, Rev: int64(resp.Node.ModifiedIndex)}
+			if resp.Action == "delete" || resp.Action == "expire" {
+				evt.Type = EventTypeDelete
+			}
+			out <- evt
+		}
+	}()
+
+	cancel := func() { close(stop) }
+	return out, cancel, nil
+}
+
+func (kv *etcdv2KV) Close() error {
+	return nil
+}
+
+func isEtcdV2NotFound(err error) bool {
+	eerr, ok := err.(*etcd.EtcdError)
+	return ok && eerr.ErrorCode == etcd.ErrorCodeKeyNotFound
+}
+
+// etcdv2Txn only supports the two compare-and-swap shapes the storage
+// package actually issues: "create key if it does not yet exist" and
+// "replace key if its value still matches what was last read". etcd v2 has
+// no multi-key transactions, so both are built on top of CompareAndSwap
+// rather than a generic If/Then/Else.
+type etcdv2Txn struct {
+	client *etcd.Client
+	cmps   []Cmp
+	thenOp []Op
+	elseOp []Op
+}
+
+func (t *etcdv2Txn) If(cmps ...Cmp) Txn {
+	t.cmps = cmps
+	return t
+}
+
+func (t *etcdv2Txn) Then(ops ...Op) Txn {
+	t.thenOp = ops
+	return t
+}
+
+func (t *etcdv2Txn) Else(ops ...Op) Txn {
+	t.elseOp = ops
+	return t
+}
+
+func (t *etcdv2Txn) Commit() (*TxnResponse, error) {
+	if len(t.cmps) != 1 || len(t.thenOp) != 1 || t.thenOp[0].Type != OpPut {
+		return nil, errors.Errorf("storage: etcdv2 only supports single-key create-if-absent or value-CAS transactions")
+	}
+
+	cmp := t.cmps[0]
+	key := cmp.Key
+	newValue := string(t.thenOp[0].Value)
+
+	var err error
+	switch cmp.Target {
+	case CmpValue:
+		prevValue, _ := cmp.Value.(string)
+		_, err = t.client.CompareAndSwap(key, newValue, 0, prevValue, 0)
+	default:
+		_, err = t.client.Create(key, newValue, 0)
+	}
+
+	if err == nil {
+		return &TxnResponse{Succeeded: true}, nil
+	}
+
+	if !isEtcdV2NodeExist(err) && !isEtcdV2TestFailed(err) {
+		return nil, errors.Wrap(err, "")
+	}
+
+	// lost the race: run the Else branch, which in this codebase is always a
+	// read-back of the already committed value.
+	resp := &TxnResponse{Succeeded: false}
+	for _, op := range t.elseOp {
+		if op.Type != OpGet {
+			continue
+		}
+		getResp, err := t.client.Get(op.Key, false, false)
+		if err != nil {
+			if isEtcdV2NotFound(err) {
+				continue
+			}
+			return nil, errors.Wrap(err, "")
+		}
+		resp.Responses = append(resp.Responses, OpResponse{Kvs: []KV{{Key: op.Key, Value: []byte(getResp.Node.Value)}}})
+	}
+
+	return resp, nil
+}
+
+func isEtcdV2NodeExist(err error) bool {
+	eerr, ok := err.(*etcd.EtcdError)
+	return ok && eerr.ErrorCode == etcd.ErrorCodeNodeExist
+}
+
+func isEtcdV2TestFailed(err error) bool {
+	eerr, ok := err.(*etcd.EtcdError)
+	return ok && eerr.ErrorCode == etcd.ErrorCodeTestFailed
+}
+
+// etcdv2Session is an etcdv3Session equivalent for v2: a dedicated node,
+// kept alive by resetting its TTL on a timer, whose disappearance (refresh
+// failure) closes Done.
+type etcdv2Session struct {
+	done chan struct{}
+	stop chan struct{}
+}
+
+func (s *etcdv2Session) Done() <-chan struct{} {
+	return s.done
+}
+
+func (s *etcdv2Session) Close() error {
+	close(s.stop)
+	return nil
+}
+
+// etcdv2CampaignRetryInterval is how often a blocked Campaign retries
+// acquiring rootPath. etcd v2 has no equivalent of etcd v3's
+// concurrency.Election, which wakes up a waiter as soon as the key is
+// freed, so this backend falls back to polling.
+const etcdv2CampaignRetryInterval = 500 * time.Millisecond
+
+// etcdv2Election implements leader election on top of etcd v2's
+// CompareAndSwap, retrying until it wins or ctx is done to match
+// etcdv3Election's blocking campaign semantics, plus a TTL-node backed
+// Session. The leader key itself carries the session's TTL and is
+// refreshed alongside the session's own keep-alive node, so a dead process
+// loses leadership within one TTL instead of holding it forever.
+type etcdv2Election struct {
+	client   *etcd.Client
+	rootPath string
+
+	mu       sync.Mutex
+	session  *etcdv2Session
+	leaderID string
+}
+
+func (e *etcdv2Election) sessionKey() string {
+	return e.rootPath + "-lease"
+}
+
+// ensureSession returns the current Session, starting a fresh keep-alive
+// loop if there is none yet or the previous one's node expired.
+func (e *etcdv2Election) ensureSession() *etcdv2Session {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.session != nil {
+		select {
+		case <-e.session.Done():
+			// lease lost: fall through and start a fresh one.
+		default:
+			return e.session
+		}
+	}
+
+	s := &etcdv2Session{done: make(chan struct{}), stop: make(chan struct{})}
+	go e.keepAlive(s)
+	e.session = s
+
+	return s
+}
+
+func (e *etcdv2Election) keepAlive(s *etcdv2Session) {
+	defer close(s.done)
+
+	key := e.sessionKey()
+	if _, err := e.client.Set(key, "alive", etcdv2SessionTTL); err != nil {
+		return
+	}
+
+	ticker := time.NewTicker(etcdv2SessionTTL / 2 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			e.client.Delete(key, false)
+			return
+		case <-ticker.C:
+			if _, err := e.client.Set(key, "alive", etcdv2SessionTTL); err != nil {
+				return
+			}
+			e.refreshLeaderKey()
+		}
+	}
+}
+
+// refreshLeaderKey resets the leader key's TTL so it stays alive only for as
+// long as this session's keep-alive loop keeps renewing it, tying it to the
+// same liveness signal as the session itself. If this instance's process
+// dies before the next tick, the key expires on its own and another
+// instance's Campaign can win it - unlike a TTL-0 key, which would otherwise
+// outlive the process that created it and wedge the election forever.
+func (e *etcdv2Election) refreshLeaderKey() {
+	e.mu.Lock()
+	leaderID := e.leaderID
+	e.mu.Unlock()
+
+	if leaderID == "" {
+		return
+	}
+
+	e.client.CompareAndSwap(e.rootPath, leaderID, etcdv2SessionTTL, leaderID, 0)
+}
+
+func (e *etcdv2Election) Session() Session {
+	return e.ensureSession()
+}
+
+func newEtcdV2Election(endpoints []string, rootPath string) (Election, error) {
+	client := etcd.NewClient(endpoints)
+	if !client.SyncCluster() {
+		return nil, errors.Errorf("storage: failed to sync etcdv2 cluster %v", endpoints)
+	}
+
+	return &etcdv2Election{client: client, rootPath: rootPath}, nil
+}
+
+func (e *etcdv2Election) Campaign(ctx context.Context, leaderID string) error {
+	e.ensureSession()
+
+	ticker := time.NewTicker(etcdv2CampaignRetryInterval)
+	defer ticker.Stop()
+
+	for {
+		_, err := e.client.Create(e.rootPath, leaderID, etcdv2SessionTTL)
+		if err == nil {
+			e.mu.Lock()
+			e.leaderID = leaderID
+			e.mu.Unlock()
+			return nil
+		}
+
+		if !isEtcdV2NodeExist(err) {
+			return errors.Wrap(err, "")
+		}
+
+		select {
+		case <-ctx.Done():
+			return errors.Wrap(ctx.Err(), "")
+		case <-ticker.C:
+		}
+	}
+}
+
+// Resign only removes rootPath if this instance is the one that created it,
+// via a CompareAndDelete against the leaderID it wrote in Campaign. A blind
+// Delete would tear down whoever holds leadership now, including a
+// different PD that won a later Campaign after this instance's own lease
+// was lost.
+func (e *etcdv2Election) Resign(ctx context.Context) error {
+	e.mu.Lock()
+	leaderID := e.leaderID
+	e.leaderID = ""
+	e.mu.Unlock()
+
+	if leaderID == "" {
+		return nil
+	}
+
+	_, err := e.client.CompareAndDelete(e.rootPath, leaderID, 0)
+	if err != nil {
+		if isEtcdV2NotFound(err) || isEtcdV2TestFailed(err) {
+			// already gone, or someone else holds it now: nothing to do.
+			return nil
+		}
+		return errors.Wrap(err, "")
+	}
+
+	return nil
+}
+
+func (e *etcdv2Election) Leader(ctx context.Context) (string, int64, error) {
+	resp, err := e.client.Get(e.rootPath, false, false)
+	if err != nil {
+		if isEtcdV2NotFound(err) {
+			return "", 0, nil
+		}
+		return "", 0, errors.Wrap(err, "")
+	}
+
+	return resp.Node.Value, int64(resp.Node.ModifiedIndex), nil
+}
+
+func (e *etcdv2Election) Observe(ctx context.Context) <-chan LeaderEvent {
+	out := make(chan LeaderEvent)
+	stop := make(chan bool)
+	receiver := make(chan *etcd.Response)
+
+	go func() {
+		<-ctx.Done()
+		close(stop)
+	}()
+
+	go func() {
+		e.client.Watch(e.rootPath, 0, false, receiver, stop)
+	}()
+
+	go func() {
+		defer close(out)
+		for resp := range receiver {
+			out <- LeaderEvent{LeaderID: resp.Node.Value, Rev: int64(resp.Node.ModifiedIndex)}
+		}
+	}()
+
+	return out
+}
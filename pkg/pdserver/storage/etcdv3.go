@@ -0,0 +1,358 @@
+// Copyright 2016 DeepFabric, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"context"
+	"sync"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/clientv3/concurrency"
+	"github.com/pkg/errors"
+)
+
+// defaultSessionTTL is the lease TTL backing an etcdv3 Session, in seconds.
+// It matches concurrency.Session's own default, giving the lease time to
+// survive a brief network blip without a healthy PD losing leadership.
+const defaultSessionTTL = 10
+
+// etcdv3KV is the KVStore driver backing the current, etcd v3 only,
+// behavior of Store.
+type etcdv3KV struct {
+	client *clientv3.Client
+}
+
+func newEtcdV3KV(endpoints []string) (KVStore, error) {
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints:   endpoints,
+		DialTimeout: DefaultTimeout,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+
+	return &etcdv3KV{client: client}, nil
+}
+
+func (kv *etcdv3KV) Get(ctx context.Context, key string) ([]byte, error) {
+	resp, err := kv.client.Get(ctx, key)
+	if err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+
+	if len(resp.Kvs) == 0 {
+		return nil, nil
+	}
+
+	return resp.Kvs[0].Value, nil
+}
+
+func (kv *etcdv3KV) List(ctx context.Context, key, rangeEnd string, limit int64) ([]KV, error) {
+	kvs, _, err := kv.ListWithRev(ctx, key, rangeEnd, limit)
+	return kvs, err
+}
+
+func (kv *etcdv3KV) ListWithRev(ctx context.Context, key, rangeEnd string, limit int64) ([]KV, int64, error) {
+	opts := []clientv3.OpOption{clientv3.WithRange(rangeEnd)}
+	if limit > 0 {
+		opts = append(opts, clientv3.WithLimit(limit))
+	}
+
+	resp, err := kv.client.Get(ctx, key, opts...)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "")
+	}
+
+	kvs := make([]KV, 0, len(resp.Kvs))
+	for _, item := range resp.Kvs {
+		kvs = append(kvs, KV{Key: string(item.Key), Value: item.Value})
+	}
+
+	return kvs, resp.Header.Revision, nil
+}
+
+func (kv *etcdv3KV) Put(ctx context.Context, key string, value []byte) error {
+	_, err := kv.client.Put(ctx, key, string(value))
+	return errors.Wrap(err, "")
+}
+
+func (kv *etcdv3KV) Delete(ctx context.Context, key string) error {
+	_, err := kv.client.Delete(ctx, key)
+	return errors.Wrap(err, "")
+}
+
+func (kv *etcdv3KV) Txn(ctx context.Context) Txn {
+	return &etcdv3Txn{txn: kv.client.Txn(ctx)}
+}
+
+func (kv *etcdv3KV) Watch(ctx context.Context, key, rangeEnd string, fromRev int64) (<-chan WatchEvent, CancelFunc, error) {
+	opts := []clientv3.OpOption{clientv3.WithRange(rangeEnd)}
+	if fromRev > 0 {
+		opts = append(opts, clientv3.WithRev(fromRev))
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	wc := kv.client.Watch(ctx, key, opts...)
+
+	out := make(chan WatchEvent)
+	go func() {
+		defer close(out)
+		for resp := range wc {
+			if err := resp.Err(); err != nil {
+				// most notably ErrCompacted: fromRev has fallen out of the
+				// backend's retained history. Surface it and stop; the
+				// caller is expected to fall back to a full snapshot and
+				// re-attach the watch at the snapshot's revision.
+				out <- WatchEvent{Err: err}
+				return
+			}
+
+			for _, ev := range resp.Events {
+				evt := WatchEvent{KV: KV{Key: string(ev.Kv.Key), Value: ev.Kv.Value}, Rev: ev.Kv.ModRevision}
+				if ev.Type == clientv3.EventTypeDelete {
+					evt.Type = EventTypeDelete
+				}
+				out <- evt
+			}
+		}
+	}()
+
+	return out, CancelFunc(cancel), nil
+}
+
+func (kv *etcdv3KV) Close() error {
+	return errors.Wrap(kv.client.Close(), "")
+}
+
+// Members returns the current etcd cluster member list. This is an
+// etcdv3-only capability; callers type-assert for it rather than it being
+// part of the generic KVStore contract.
+func (kv *etcdv3KV) Members(ctx context.Context) (*clientv3.MemberListResponse, error) {
+	resp, err := kv.client.MemberList(ctx)
+	return resp, errors.Wrap(err, "")
+}
+
+type etcdv3Txn struct {
+	txn clientv3.Txn
+}
+
+func (t *etcdv3Txn) If(cmps ...Cmp) Txn {
+	t.txn = t.txn.If(toEtcdCmps(cmps)...)
+	return t
+}
+
+func (t *etcdv3Txn) Then(ops ...Op) Txn {
+	t.txn = t.txn.Then(toEtcdOps(ops)...)
+	return t
+}
+
+func (t *etcdv3Txn) Else(ops ...Op) Txn {
+	t.txn = t.txn.Else(toEtcdOps(ops)...)
+	return t
+}
+
+func (t *etcdv3Txn) Commit() (*TxnResponse, error) {
+	resp, err := t.txn.Commit()
+	if err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+
+	out := &TxnResponse{Succeeded: resp.Succeeded}
+	for _, r := range resp.Responses {
+		rangeResp := r.GetResponseRange()
+		if rangeResp == nil {
+			out.Responses = append(out.Responses, OpResponse{})
+			continue
+		}
+
+		kvs := make([]KV, 0, len(rangeResp.Kvs))
+		for _, item := range rangeResp.Kvs {
+			kvs = append(kvs, KV{Key: string(item.Key), Value: item.Value})
+		}
+		out.Responses = append(out.Responses, OpResponse{Kvs: kvs})
+	}
+
+	return out, nil
+}
+
+func toEtcdCmps(cmps []Cmp) []clientv3.Cmp {
+	out := make([]clientv3.Cmp, 0, len(cmps))
+	for _, c := range cmps {
+		switch c.Target {
+		case CmpModRevision:
+			out = append(out, clientv3.Compare(clientv3.ModRevision(c.Key), c.Result, c.Value))
+		case CmpValue:
+			out = append(out, clientv3.Compare(clientv3.Value(c.Key), c.Result, c.Value))
+		default:
+			out = append(out, clientv3.Compare(clientv3.CreateRevision(c.Key), c.Result, c.Value))
+		}
+	}
+	return out
+}
+
+func toEtcdOps(ops []Op) []clientv3.Op {
+	out := make([]clientv3.Op, 0, len(ops))
+	for _, op := range ops {
+		switch op.Type {
+		case OpPut:
+			out = append(out, clientv3.OpPut(op.Key, string(op.Value)))
+		case OpDelete:
+			out = append(out, clientv3.OpDelete(op.Key))
+		default:
+			out = append(out, clientv3.OpGet(op.Key))
+		}
+	}
+	return out
+}
+
+// etcdv3Session wraps a concurrency.Session, the lease PD's continuous
+// leader election is tied to.
+type etcdv3Session struct {
+	session *concurrency.Session
+}
+
+func (s *etcdv3Session) Done() <-chan struct{} {
+	return s.session.Done()
+}
+
+func (s *etcdv3Session) Close() error {
+	return errors.Wrap(s.session.Close(), "")
+}
+
+// etcdv3Election is PD's continuous leader election: a concurrency.Session
+// owning a lease, and a concurrency.Election campaigning on top of it. A
+// lost lease (network partition, process pause past the TTL) closes the
+// session's Done channel, and the next Campaign call transparently opens a
+// fresh session rather than campaigning on a dead one.
+type etcdv3Election struct {
+	client   *clientv3.Client
+	rootPath string
+
+	mu       sync.Mutex
+	session  *etcdv3Session
+	election *concurrency.Election
+}
+
+func newEtcdV3Election(endpoints []string, rootPath string) (Election, error) {
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints:   endpoints,
+		DialTimeout: DefaultTimeout,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+
+	return &etcdv3Election{client: client, rootPath: rootPath}, nil
+}
+
+// ensureSession returns the current concurrency.Election, opening a fresh
+// Session (and therefore a fresh lease) if there is none yet or the
+// previous one's lease was lost.
+func (e *etcdv3Election) ensureSession() (*concurrency.Election, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.session != nil {
+		select {
+		case <-e.session.Done():
+			// lease lost: fall through and open a fresh one.
+		default:
+			return e.election, nil
+		}
+	}
+
+	session, err := concurrency.NewSession(e.client, concurrency.WithTTL(defaultSessionTTL))
+	if err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+
+	e.session = &etcdv3Session{session: session}
+	e.election = concurrency.NewElection(session, e.rootPath)
+
+	return e.election, nil
+}
+
+func (e *etcdv3Election) Campaign(ctx context.Context, leaderID string) error {
+	election, err := e.ensureSession()
+	if err != nil {
+		return err
+	}
+
+	return errors.Wrap(election.Campaign(ctx, leaderID), "")
+}
+
+func (e *etcdv3Election) Resign(ctx context.Context) error {
+	e.mu.Lock()
+	election := e.election
+	e.mu.Unlock()
+
+	if election == nil {
+		return nil
+	}
+
+	return errors.Wrap(election.Resign(ctx), "")
+}
+
+func (e *etcdv3Election) Leader(ctx context.Context) (string, int64, error) {
+	election, err := e.ensureSession()
+	if err != nil {
+		return "", 0, err
+	}
+
+	resp, err := election.Leader(ctx)
+	if err != nil {
+		if err == concurrency.ErrElectionNoLeader {
+			return "", 0, nil
+		}
+		return "", 0, errors.Wrap(err, "")
+	}
+
+	if len(resp.Kvs) == 0 {
+		return "", 0, nil
+	}
+
+	return string(resp.Kvs[0].Value), resp.Kvs[0].ModRevision, nil
+}
+
+func (e *etcdv3Election) Observe(ctx context.Context) <-chan LeaderEvent {
+	out := make(chan LeaderEvent)
+
+	go func() {
+		defer close(out)
+
+		election, err := e.ensureSession()
+		if err != nil {
+			return
+		}
+
+		for resp := range election.Observe(ctx) {
+			if len(resp.Kvs) == 0 {
+				continue
+			}
+			out <- LeaderEvent{LeaderID: string(resp.Kvs[0].Value), Rev: resp.Kvs[0].ModRevision}
+		}
+	}()
+
+	return out
+}
+
+func (e *etcdv3Election) Session() Session {
+	if _, err := e.ensureSession(); err != nil {
+		return nil
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.session
+}
@@ -0,0 +1,308 @@
+// Copyright 2016 DeepFabric, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build integration
+// +build integration
+
+package storage
+
+// Per-backend integration tests for etcdv2KV/etcdv2Election and
+// consulKV/consulElection, driving the real client libraries against a live
+// cluster rather than fakeKV. They only build with -tags integration, and
+// each backend's tests additionally skip themselves when that backend's
+// endpoint env var is unset, so a plain `go test ./...` - with or without
+// -tags integration - never needs a live etcd v2 or Consul running:
+//
+//	ETCDV2_ENDPOINTS=http://127.0.0.1:4001 go test -tags integration ./pkg/pdserver/storage/... -run EtcdV2
+//	CONSUL_ENDPOINTS=127.0.0.1:8500 go test -tags integration ./pkg/pdserver/storage/... -run Consul
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func etcdv2TestEndpoints(t *testing.T) []string {
+	t.Helper()
+
+	raw := strings.TrimSpace(os.Getenv("ETCDV2_ENDPOINTS"))
+	if raw == "" {
+		t.Skip("ETCDV2_ENDPOINTS not set, skipping etcdv2 integration test")
+	}
+
+	return strings.Split(raw, ",")
+}
+
+func consulTestEndpoints(t *testing.T) []string {
+	t.Helper()
+
+	raw := strings.TrimSpace(os.Getenv("CONSUL_ENDPOINTS"))
+	if raw == "" {
+		t.Skip("CONSUL_ENDPOINTS not set, skipping consul integration test")
+	}
+
+	return strings.Split(raw, ",")
+}
+
+// testRoot returns a key prefix unique to this test run, so concurrent runs
+// and leftovers from a previous failed run never collide.
+func testRoot(t *testing.T, name string) string {
+	t.Helper()
+	return fmt.Sprintf("/pd-integration-test/%s/%d", name, time.Now().UnixNano())
+}
+
+func TestEtcdV2KVPutGetDelete(t *testing.T) {
+	kv, err := newEtcdV2KV(etcdv2TestEndpoints(t))
+	if err != nil {
+		t.Fatalf("newEtcdV2KV: %v", err)
+	}
+	defer kv.Close()
+
+	ctx := context.Background()
+	key := testRoot(t, "kv") + "/key"
+
+	if v, err := kv.Get(ctx, key); err != nil || v != nil {
+		t.Fatalf("Get before Put: v=%v err=%v", v, err)
+	}
+
+	if err := kv.Put(ctx, key, []byte("v1")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	v, err := kv.Get(ctx, key)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if string(v) != "v1" {
+		t.Fatalf("Get: expected v1, got %q", v)
+	}
+
+	if err := kv.Delete(ctx, key); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if v, err := kv.Get(ctx, key); err != nil || v != nil {
+		t.Fatalf("Get after Delete: v=%v err=%v", v, err)
+	}
+}
+
+// TestEtcdV2KVListRange exercises the fix for etcdv2KV.ListWithRev: a range
+// scan in [key, rangeEnd) against padded leaf keys must return every key in
+// range, not just a key that happens to equal the literal start key.
+func TestEtcdV2KVListRange(t *testing.T) {
+	kv, err := newEtcdV2KV(etcdv2TestEndpoints(t))
+	if err != nil {
+		t.Fatalf("newEtcdV2KV: %v", err)
+	}
+	defer kv.Close()
+
+	ctx := context.Background()
+	root := testRoot(t, "kv-range")
+
+	for i := 1; i <= 5; i++ {
+		key := fmt.Sprintf("%s/%020d", root, i)
+		if err := kv.Put(ctx, key, []byte("v")); err != nil {
+			t.Fatalf("Put %s: %v", key, err)
+		}
+	}
+
+	start := fmt.Sprintf("%s/%020d", root, 2)
+	end := fmt.Sprintf("%s/%020d", root, 4)
+
+	kvs, err := kv.List(ctx, start, end, 0)
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if len(kvs) != 2 {
+		t.Fatalf("List(%s, %s): expected 2 keys, got %d: %+v", start, end, len(kvs), kvs)
+	}
+}
+
+func TestEtcdV2ElectionCampaignResign(t *testing.T) {
+	endpoints := etcdv2TestEndpoints(t)
+	rootPath := testRoot(t, "election")
+
+	first, err := newEtcdV2Election(endpoints, rootPath)
+	if err != nil {
+		t.Fatalf("newEtcdV2Election: %v", err)
+	}
+	second, err := newEtcdV2Election(endpoints, rootPath)
+	if err != nil {
+		t.Fatalf("newEtcdV2Election: %v", err)
+	}
+
+	ctx := context.Background()
+	if err := first.Campaign(ctx, "first"); err != nil {
+		t.Fatalf("first Campaign: %v", err)
+	}
+
+	won := make(chan error, 1)
+	blockedCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() { won <- second.Campaign(blockedCtx, "second") }()
+
+	select {
+	case err := <-won:
+		t.Fatalf("second Campaign won before first Resign: err=%v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	if err := first.Resign(ctx); err != nil {
+		t.Fatalf("first Resign: %v", err)
+	}
+
+	select {
+	case err := <-won:
+		if err != nil {
+			t.Fatalf("second Campaign: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("second Campaign never won after first Resign")
+	}
+
+	leaderID, _, err := first.Leader(ctx)
+	if err != nil {
+		t.Fatalf("Leader: %v", err)
+	}
+	if leaderID != "second" {
+		t.Fatalf("expected leader \"second\", got %q", leaderID)
+	}
+
+	if err := second.Resign(ctx); err != nil {
+		t.Fatalf("second Resign: %v", err)
+	}
+}
+
+func TestConsulKVPutGetDelete(t *testing.T) {
+	kv, err := newConsulKV(consulTestEndpoints(t))
+	if err != nil {
+		t.Fatalf("newConsulKV: %v", err)
+	}
+	defer kv.Close()
+
+	ctx := context.Background()
+	key := testRoot(t, "kv") + "/key"
+
+	if v, err := kv.Get(ctx, key); err != nil || v != nil {
+		t.Fatalf("Get before Put: v=%v err=%v", v, err)
+	}
+
+	if err := kv.Put(ctx, key, []byte("v1")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	v, err := kv.Get(ctx, key)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if string(v) != "v1" {
+		t.Fatalf("Get: expected v1, got %q", v)
+	}
+
+	if err := kv.Delete(ctx, key); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if v, err := kv.Get(ctx, key); err != nil || v != nil {
+		t.Fatalf("Get after Delete: v=%v err=%v", v, err)
+	}
+}
+
+// TestConsulKVListRange exercises the fix for consulKV.ListWithRev: Consul's
+// literal byte-prefix List must be scoped to the shared parent prefix and
+// filtered client-side to [key, rangeEnd), not issued against a single
+// padded leaf key that can only ever match itself.
+func TestConsulKVListRange(t *testing.T) {
+	kv, err := newConsulKV(consulTestEndpoints(t))
+	if err != nil {
+		t.Fatalf("newConsulKV: %v", err)
+	}
+	defer kv.Close()
+
+	ctx := context.Background()
+	root := testRoot(t, "kv-range")
+
+	for i := 1; i <= 5; i++ {
+		key := fmt.Sprintf("%s/%020d", root, i)
+		if err := kv.Put(ctx, key, []byte("v")); err != nil {
+			t.Fatalf("Put %s: %v", key, err)
+		}
+	}
+
+	start := fmt.Sprintf("%s/%020d", root, 2)
+	end := fmt.Sprintf("%s/%020d", root, 4)
+
+	kvs, err := kv.List(ctx, start, end, 0)
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if len(kvs) != 2 {
+		t.Fatalf("List(%s, %s): expected 2 keys, got %d: %+v", start, end, len(kvs), kvs)
+	}
+}
+
+func TestConsulElectionCampaignResign(t *testing.T) {
+	endpoints := consulTestEndpoints(t)
+	rootPath := testRoot(t, "election")
+
+	first, err := newConsulElection(endpoints, rootPath)
+	if err != nil {
+		t.Fatalf("newConsulElection: %v", err)
+	}
+	second, err := newConsulElection(endpoints, rootPath)
+	if err != nil {
+		t.Fatalf("newConsulElection: %v", err)
+	}
+
+	ctx := context.Background()
+	if err := first.Campaign(ctx, "first"); err != nil {
+		t.Fatalf("first Campaign: %v", err)
+	}
+
+	won := make(chan error, 1)
+	blockedCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() { won <- second.Campaign(blockedCtx, "second") }()
+
+	select {
+	case err := <-won:
+		t.Fatalf("second Campaign won before first Resign: err=%v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	if err := first.Resign(ctx); err != nil {
+		t.Fatalf("first Resign: %v", err)
+	}
+
+	select {
+	case err := <-won:
+		if err != nil {
+			t.Fatalf("second Campaign: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("second Campaign never won after first Resign")
+	}
+
+	leaderID, _, err := first.Leader(ctx)
+	if err != nil {
+		t.Fatalf("Leader: %v", err)
+	}
+	if leaderID != "second" {
+		t.Fatalf("expected leader \"second\", got %q", leaderID)
+	}
+
+	if err := second.Resign(ctx); err != nil {
+		t.Fatalf("second Resign: %v", err)
+	}
+}
@@ -0,0 +1,255 @@
+// Copyright 2016 DeepFabric, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"context"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Backend identifies a supported KVStore/Election driver.
+type Backend string
+
+const (
+	// BackendEtcdV3 talks to an etcd v3 cluster via clientv3. This is the
+	// backend PD has always used.
+	BackendEtcdV3 Backend = "etcdv3"
+	// BackendEtcdV2 talks to an etcd v2 cluster via go-etcd/client.
+	BackendEtcdV2 Backend = "etcdv2"
+	// BackendConsul talks to a Consul cluster via hashicorp/consul/api.
+	BackendConsul Backend = "consul"
+)
+
+// KV is a single key/value pair returned by a KVStore read.
+type KV struct {
+	Key   string
+	Value []byte
+}
+
+// OpType identifies the kind of operation carried by an Op.
+type OpType int
+
+const (
+	// OpPut writes Value at Key.
+	OpPut OpType = iota
+	// OpDelete removes Key.
+	OpDelete
+	// OpGet reads the value at Key; only meaningful inside a Txn branch, so
+	// the result can be recovered from TxnResponse without a second round
+	// trip.
+	OpGet
+)
+
+// Op describes a single operation submitted as part of a Txn branch.
+type Op struct {
+	Type  OpType
+	Key   string
+	Value []byte
+}
+
+// CmpTarget identifies what part of a key a Cmp compares.
+type CmpTarget int
+
+const (
+	// CmpCreateRevision compares the revision a key was created at. Backends
+	// without MVCC revisions (etcdv2, consul) approximate this with 0 meaning
+	// "key does not exist" and non-zero otherwise.
+	CmpCreateRevision CmpTarget = iota
+	// CmpModRevision compares the revision a key was last modified at.
+	CmpModRevision
+	// CmpValue compares the value stored at a key.
+	CmpValue
+)
+
+// Cmp is a single comparison used in Txn.If. Result is one of "=", "!=",
+// ">", "<", mirroring clientv3.Compare.
+type Cmp struct {
+	Key    string
+	Target CmpTarget
+	Result string
+	Value  interface{}
+}
+
+// OpResponse carries the result of a single Op executed inside a Txn
+// branch. Only OpGet populates Kvs.
+type OpResponse struct {
+	Kvs []KV
+}
+
+// TxnResponse is the result of a Txn.Commit call.
+type TxnResponse struct {
+	Succeeded bool
+	Responses []OpResponse
+}
+
+// Txn builds a compare-and-swap transaction against a KVStore: if every Cmp
+// in If holds, Then runs; otherwise Else runs. It is the primitive every
+// "only one PD wins" bootstrap check is built from.
+type Txn interface {
+	If(cmps ...Cmp) Txn
+	Then(ops ...Op) Txn
+	Else(ops ...Op) Txn
+	Commit() (*TxnResponse, error)
+}
+
+// EventType identifies the kind of change delivered by a Watch.
+type EventType int
+
+const (
+	// EventTypePut reports a create or update of KV.
+	EventTypePut EventType = iota
+	// EventTypeDelete reports the removal of KV.
+	EventTypeDelete
+)
+
+// WatchEvent is a single change delivered on a channel returned by
+// KVStore.Watch. On the etcdv3 backend, Err is set, and the channel closed
+// right after, when the watch ended abnormally - most notably when fromRev
+// has been compacted away, a concept only etcdv3 has. The etcdv2 and consul
+// drivers close the channel on a failed watch without sending an Err event.
+type WatchEvent struct {
+	Type EventType
+	KV   KV
+	Rev  int64
+	Err  error
+}
+
+// CancelFunc stops a Watch and releases the resources backing it.
+type CancelFunc func()
+
+// dirPrefix returns the literal prefix backends without true range queries
+// (etcdv2, consul) must list against to enumerate key's siblings - key
+// itself is usually a single padded leaf like
+// ".../stores/00000000000000000000", not a prefix anything else starts
+// with, so listing key directly only ever turns up key.
+func dirPrefix(key string) string {
+	idx := strings.LastIndex(key, "/")
+	if idx < 0 {
+		return key
+	}
+	return key[:idx+1]
+}
+
+// prefixRangeEnd returns the exclusive upper bound of the range spanning
+// every key starting with prefix: the same increment-last-byte algorithm
+// clientv3.GetPrefixRangeEnd uses.
+func prefixRangeEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	return ""
+}
+
+// KVStore is the minimal key/value contract every PD storage backend must
+// satisfy. Store only ever talks to a KVStore, never to a specific client
+// library, so etcdv3, etcdv2 and consul can all sit behind it.
+type KVStore interface {
+	// Get returns the value stored at key, or nil if it does not exist.
+	Get(ctx context.Context, key string) ([]byte, error)
+	// List returns the KVs in [key, rangeEnd), at most limit of them ordered
+	// by key. A limit <= 0 means unbounded.
+	List(ctx context.Context, key, rangeEnd string, limit int64) ([]KV, error)
+	// ListWithRev is List plus the backend's revision/index at the moment of
+	// the read, so a caller can later resume a Watch from exactly this
+	// point with no race window between the snapshot and the watch.
+	ListWithRev(ctx context.Context, key, rangeEnd string, limit int64) ([]KV, int64, error)
+	// Put writes value at key.
+	Put(ctx context.Context, key string, value []byte) error
+	// Delete removes key.
+	Delete(ctx context.Context, key string) error
+	// Txn starts a new compare-and-swap transaction bound to ctx.
+	Txn(ctx context.Context) Txn
+	// Watch streams changes to keys in [key, rangeEnd) starting at fromRev.
+	// fromRev <= 0 means watch from now. The returned CancelFunc must be
+	// called to release the watch.
+	Watch(ctx context.Context, key, rangeEnd string, fromRev int64) (<-chan WatchEvent, CancelFunc, error)
+	// Close releases all resources held by the backend.
+	Close() error
+}
+
+// NewKVStore creates the KVStore driver selected by backend against
+// endpoints. An empty backend defaults to BackendEtcdV3 for compatibility
+// with clusters that predate backend selection.
+func NewKVStore(backend Backend, endpoints []string) (KVStore, error) {
+	switch backend {
+	case BackendEtcdV3, "":
+		return newEtcdV3KV(endpoints)
+	case BackendEtcdV2:
+		return newEtcdV2KV(endpoints)
+	case BackendConsul:
+		return newConsulKV(endpoints)
+	default:
+		return nil, errors.Errorf("storage: unsupported backend %q", backend)
+	}
+}
+
+// NewElection creates the Election driver selected by backend. rootPath is
+// the key prefix (etcdv3) or the key (etcdv2, consul) the leader record is
+// stored under.
+func NewElection(backend Backend, endpoints []string, rootPath string) (Election, error) {
+	switch backend {
+	case BackendEtcdV3, "":
+		return newEtcdV3Election(endpoints, rootPath)
+	case BackendEtcdV2:
+		return newEtcdV2Election(endpoints, rootPath)
+	case BackendConsul:
+		return newConsulElection(endpoints, rootPath)
+	default:
+		return nil, errors.Errorf("storage: unsupported backend %q", backend)
+	}
+}
+
+// Election is the leader-election contract every PD storage backend must
+// satisfy.
+type Election interface {
+	// Campaign blocks until leaderID becomes the leader, or ctx is done.
+	Campaign(ctx context.Context, leaderID string) error
+	// Resign gives up leadership, if currently held.
+	Resign(ctx context.Context) error
+	// Leader returns the current leader id and the revision it was elected
+	// at, or ("", 0, nil) if there is no leader yet.
+	Leader(ctx context.Context) (string, int64, error)
+	// Observe streams leader changes until ctx is done.
+	Observe(ctx context.Context) <-chan LeaderEvent
+	// Session returns the Session backing this Election's lease, creating
+	// one on first call. Campaign transparently acquires a fresh Session
+	// if the previous one's lease was lost.
+	Session() Session
+}
+
+// LeaderEvent reports a change of leadership observed via Election.Observe.
+type LeaderEvent struct {
+	LeaderID string
+	Rev      int64
+}
+
+// Session owns the lease (etcd) or native session (Consul) an Election's
+// leadership is tied to. It auto-renews that lease for as long as the
+// process is alive and closes Done when the lease is lost - expired,
+// revoked, or the backing connection died - so a leader can step down
+// deterministically instead of discovering it the hard way on its next
+// write.
+type Session interface {
+	// Done is closed when the session's lease is lost, and never fires
+	// again afterwards.
+	Done() <-chan struct{}
+	// Close gives up the session, releasing its lease immediately.
+	Close() error
+}
@@ -0,0 +1,303 @@
+// Copyright 2016 DeepFabric, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/deepfabric/elasticell/pkg/pb/metapb"
+	"github.com/deepfabric/elasticell/pkg/util"
+	"github.com/pkg/errors"
+)
+
+// Transformer rewrites a single key/value pair as it is copied from the
+// source store to the destination, letting a caller rename paths, re-shard
+// cell IDs or upgrade a protobuf schema in flight. A nil Transformer (see
+// NewMigrator) copies every key/value unchanged.
+type Transformer func(key string, value []byte) (newKey string, newValue []byte, err error)
+
+// Migrator copies one cluster's metadata tree - cluster meta, stores, cells
+// - from a source Store to a destination Store, which may be on a
+// different backend or schema version.
+//
+// Cluster meta and stores are small and idempotent to recopy, so Run always
+// redoes them in full. Cells are the bulk of the tree, so Migrator
+// checkpoints the last cell ID it successfully wrote to the destination and
+// resumes from there, making Run safe to re-run after a crash.
+type Migrator struct {
+	src, dst  *Store
+	clusterID uint64
+	limit     int64
+	transform Transformer
+}
+
+// NewMigrator creates a Migrator for clusterID that copies from src to dst
+// in batches of limit, applying transform to every key/value pair.
+func NewMigrator(src, dst *Store, clusterID uint64, limit int64, transform Transformer) *Migrator {
+	if transform == nil {
+		transform = func(key string, value []byte) (string, []byte, error) { return key, value, nil }
+	}
+
+	return &Migrator{
+		src:       src,
+		dst:       dst,
+		clusterID: clusterID,
+		limit:     limit,
+		transform: transform,
+	}
+}
+
+func (m *Migrator) checkpointKey() string {
+	return fmt.Sprintf("%s/migrate/%020d/checkpoint", pdClusterRootPath, m.clusterID)
+}
+
+// Checkpoint returns the ID of the last cell successfully migrated into
+// dst, or 0 if no cell has been migrated yet.
+func (m *Migrator) Checkpoint() (uint64, error) {
+	data, err := m.dst.getValue(m.checkpointKey())
+	if err != nil {
+		return 0, err
+	}
+
+	if data == nil {
+		return 0, nil
+	}
+
+	return util.BytesToUint64(data)
+}
+
+func (m *Migrator) saveCheckpoint(cellID uint64) error {
+	return m.dst.save(m.checkpointKey(), util.Uint64ToBytes(cellID))
+}
+
+func (m *Migrator) copyOne(key string, value []byte) error {
+	newKey, newValue, err := m.transform(key, value)
+	if err != nil {
+		return errors.Wrap(err, "")
+	}
+
+	return m.dst.save(newKey, newValue)
+}
+
+// Run migrates cluster meta, then every store, then every cell starting
+// from Checkpoint, saving a new checkpoint after each migrated cell.
+func (m *Migrator) Run() error {
+	if err := m.migrateClusterMeta(); err != nil {
+		return err
+	}
+
+	if err := m.migrateStores(); err != nil {
+		return err
+	}
+
+	return m.migrateCells()
+}
+
+func (m *Migrator) migrateClusterMeta() error {
+	key := m.src.getClusterMetaKey(m.clusterID)
+	value, err := m.src.getValue(key)
+	if err != nil {
+		return err
+	}
+
+	if value == nil {
+		return nil
+	}
+
+	return m.copyOne(key, value)
+}
+
+func (m *Migrator) migrateStores() error {
+	startID := uint64(0)
+	endKey := m.src.getStoreMetaKey(m.clusterID, endID)
+
+	for {
+		startKey := m.src.getStoreMetaKey(m.clusterID, startID)
+		kvs, err := m.src.list(startKey, endKey, m.limit)
+		if err != nil {
+			return err
+		}
+
+		for _, item := range kvs {
+			if err := m.copyOne(item.Key, item.Value); err != nil {
+				return err
+			}
+
+			v := &metapb.Store{}
+			if err := v.Unmarshal(item.Value); err != nil {
+				return errors.Wrap(err, "")
+			}
+			startID = v.ID + 1
+		}
+
+		if int64(len(kvs)) < m.limit {
+			break
+		}
+	}
+
+	return nil
+}
+
+func (m *Migrator) migrateCells() error {
+	startID, err := m.Checkpoint()
+	if err != nil {
+		return err
+	}
+	if startID > 0 {
+		startID++
+	}
+
+	endKey := m.src.getCellMetaKey(m.clusterID, endID)
+
+	for {
+		startKey := m.src.getCellMetaKey(m.clusterID, startID)
+		kvs, err := m.src.list(startKey, endKey, m.limit)
+		if err != nil {
+			return err
+		}
+
+		for _, item := range kvs {
+			if err := m.copyOne(item.Key, item.Value); err != nil {
+				return err
+			}
+
+			v := &metapb.Cell{}
+			if err := v.Unmarshal(item.Value); err != nil {
+				return errors.Wrap(err, "")
+			}
+
+			startID = v.ID
+			if err := m.saveCheckpoint(startID); err != nil {
+				return err
+			}
+			startID++
+		}
+
+		if int64(len(kvs)) < m.limit {
+			break
+		}
+	}
+
+	return nil
+}
+
+// Verify re-reads every key this Migrator copies from src and compares the
+// destination's protobuf bytes against a fresh transform of the source
+// bytes, catching any write that never landed or landed stale.
+func (m *Migrator) Verify() error {
+	if err := m.verifyClusterMeta(); err != nil {
+		return err
+	}
+
+	if err := m.verifyStores(); err != nil {
+		return err
+	}
+
+	return m.verifyCells()
+}
+
+func (m *Migrator) verifyOne(key string, value []byte) error {
+	newKey, newValue, err := m.transform(key, value)
+	if err != nil {
+		return errors.Wrap(err, "")
+	}
+
+	dstValue, err := m.dst.getValue(newKey)
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(newValue, dstValue) {
+		return errors.Errorf("storage: migration verify mismatch for key %s", newKey)
+	}
+
+	return nil
+}
+
+func (m *Migrator) verifyClusterMeta() error {
+	key := m.src.getClusterMetaKey(m.clusterID)
+	value, err := m.src.getValue(key)
+	if err != nil {
+		return err
+	}
+
+	if value == nil {
+		return nil
+	}
+
+	return m.verifyOne(key, value)
+}
+
+func (m *Migrator) verifyStores() error {
+	startID := uint64(0)
+	endKey := m.src.getStoreMetaKey(m.clusterID, endID)
+
+	for {
+		startKey := m.src.getStoreMetaKey(m.clusterID, startID)
+		kvs, err := m.src.list(startKey, endKey, m.limit)
+		if err != nil {
+			return err
+		}
+
+		for _, item := range kvs {
+			if err := m.verifyOne(item.Key, item.Value); err != nil {
+				return err
+			}
+
+			v := &metapb.Store{}
+			if err := v.Unmarshal(item.Value); err != nil {
+				return errors.Wrap(err, "")
+			}
+			startID = v.ID + 1
+		}
+
+		if int64(len(kvs)) < m.limit {
+			break
+		}
+	}
+
+	return nil
+}
+
+func (m *Migrator) verifyCells() error {
+	startID := uint64(0)
+	endKey := m.src.getCellMetaKey(m.clusterID, endID)
+
+	for {
+		startKey := m.src.getCellMetaKey(m.clusterID, startID)
+		kvs, err := m.src.list(startKey, endKey, m.limit)
+		if err != nil {
+			return err
+		}
+
+		for _, item := range kvs {
+			if err := m.verifyOne(item.Key, item.Value); err != nil {
+				return err
+			}
+
+			v := &metapb.Cell{}
+			if err := v.Unmarshal(item.Value); err != nil {
+				return errors.Wrap(err, "")
+			}
+			startID = v.ID + 1
+		}
+
+		if int64(len(kvs)) < m.limit {
+			break
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,500 @@
+// Copyright 2016 DeepFabric, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/deepfabric/elasticell/pkg/pb/metapb"
+)
+
+var errCompactionForTest = errors.New("storage: fake compaction")
+
+// fakeKV is an in-memory KVStore used to exercise Store's backend-agnostic
+// logic (CAS bootstrap, compression, migration, watch/compaction fallback)
+// without a live etcd or Consul cluster. It implements exactly the CAS
+// shapes the storage package actually issues: CmpCreateRevision against 0
+// (create-if-absent) and CmpValue (replace-if-unchanged).
+type fakeKV struct {
+	mu       sync.Mutex
+	data     map[string][]byte
+	rev      int64
+	watchers []*fakeWatcher
+}
+
+type fakeWatcher struct {
+	ch       chan WatchEvent
+	key      string
+	rangeEnd string
+	done     chan struct{}
+}
+
+func newFakeKV() *fakeKV {
+	return &fakeKV{data: map[string][]byte{}}
+}
+
+func (f *fakeKV) Get(ctx context.Context, key string) ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	v, ok := f.data[key]
+	if !ok {
+		return nil, nil
+	}
+	return append([]byte(nil), v...), nil
+}
+
+func (f *fakeKV) List(ctx context.Context, key, rangeEnd string, limit int64) ([]KV, error) {
+	kvs, _, err := f.ListWithRev(ctx, key, rangeEnd, limit)
+	return kvs, err
+}
+
+func (f *fakeKV) ListWithRev(ctx context.Context, key, rangeEnd string, limit int64) ([]KV, int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var keys []string
+	for k := range f.data {
+		if k < key {
+			continue
+		}
+		if rangeEnd != "" && k >= rangeEnd {
+			continue
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	if limit > 0 && int64(len(keys)) > limit {
+		keys = keys[:limit]
+	}
+
+	kvs := make([]KV, 0, len(keys))
+	for _, k := range keys {
+		kvs = append(kvs, KV{Key: k, Value: append([]byte(nil), f.data[k]...)})
+	}
+
+	return kvs, f.rev, nil
+}
+
+func (f *fakeKV) Put(ctx context.Context, key string, value []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.putLocked(key, append([]byte(nil), value...))
+	return nil
+}
+
+func (f *fakeKV) Delete(ctx context.Context, key string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.data[key]; !ok {
+		return nil
+	}
+
+	delete(f.data, key)
+	f.rev++
+	f.notifyLocked(WatchEvent{Type: EventTypeDelete, KV: KV{Key: key}, Rev: f.rev})
+	return nil
+}
+
+func (f *fakeKV) putLocked(key string, value []byte) {
+	f.data[key] = value
+	f.rev++
+	f.notifyLocked(WatchEvent{Type: EventTypePut, KV: KV{Key: key, Value: value}, Rev: f.rev})
+}
+
+func (f *fakeKV) notifyLocked(evt WatchEvent) {
+	for _, w := range f.watchers {
+		if evt.KV.Key < w.key {
+			continue
+		}
+		if w.rangeEnd != "" && evt.KV.Key >= w.rangeEnd {
+			continue
+		}
+		select {
+		case w.ch <- evt:
+		case <-w.done:
+		}
+	}
+}
+
+func (f *fakeKV) Txn(ctx context.Context) Txn {
+	return &fakeTxn{kv: f}
+}
+
+func (f *fakeKV) Watch(ctx context.Context, key, rangeEnd string, fromRev int64) (<-chan WatchEvent, CancelFunc, error) {
+	f.mu.Lock()
+	w := &fakeWatcher{ch: make(chan WatchEvent, 16), key: key, rangeEnd: rangeEnd, done: make(chan struct{})}
+	f.watchers = append(f.watchers, w)
+	f.mu.Unlock()
+
+	var once sync.Once
+	cancel := func() {
+		once.Do(func() {
+			f.mu.Lock()
+			defer f.mu.Unlock()
+			close(w.done)
+			for i, ww := range f.watchers {
+				if ww == w {
+					f.watchers = append(f.watchers[:i], f.watchers[i+1:]...)
+					break
+				}
+			}
+		})
+	}
+
+	return w.ch, cancel, nil
+}
+
+func (f *fakeKV) Close() error { return nil }
+
+// waitForWatcher blocks until a watcher on prefix is registered, or fails
+// the test after a generous timeout. Store.WatchStores/WatchCells attach
+// their Watch asynchronously, so a test driving writes right after calling
+// them must not race the goroutine that registers the watcher.
+func (f *fakeKV) waitForWatcher(t *testing.T, prefix string) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		f.mu.Lock()
+		for _, w := range f.watchers {
+			if w.key == prefix {
+				f.mu.Unlock()
+				return
+			}
+		}
+		f.mu.Unlock()
+		time.Sleep(time.Millisecond)
+	}
+
+	t.Fatalf("timed out waiting for a watcher on %q", prefix)
+}
+
+// compact simulates a backend compacting fromRev away: every active watcher
+// on prefix gets a terminal WatchEvent{Err: err}, same as etcdv3's
+// ErrCompacted.
+func (f *fakeKV) compact(prefix string, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, w := range f.watchers {
+		if w.key != prefix {
+			continue
+		}
+		select {
+		case w.ch <- WatchEvent{Err: err}:
+		default:
+		}
+	}
+}
+
+type fakeTxn struct {
+	kv   *fakeKV
+	cmps []Cmp
+	then []Op
+	els  []Op
+}
+
+func (t *fakeTxn) If(cmps ...Cmp) Txn { t.cmps = cmps; return t }
+func (t *fakeTxn) Then(ops ...Op) Txn { t.then = ops; return t }
+func (t *fakeTxn) Else(ops ...Op) Txn { t.els = ops; return t }
+
+func (t *fakeTxn) Commit() (*TxnResponse, error) {
+	t.kv.mu.Lock()
+	defer t.kv.mu.Unlock()
+
+	ok := true
+	for _, c := range t.cmps {
+		v, exists := t.kv.data[c.Key]
+		switch c.Target {
+		case CmpCreateRevision:
+			// every caller in this package only ever checks
+			// "CreateRevision == 0", i.e. the key does not exist yet.
+			if exists {
+				ok = false
+			}
+		case CmpValue:
+			want, _ := c.Value.(string)
+			if !exists || string(v) != want {
+				ok = false
+			}
+		}
+		if !ok {
+			break
+		}
+	}
+
+	ops := t.then
+	if !ok {
+		ops = t.els
+	}
+
+	var responses []OpResponse
+	for _, op := range ops {
+		switch op.Type {
+		case OpPut:
+			t.kv.putLocked(op.Key, append([]byte(nil), op.Value...))
+			responses = append(responses, OpResponse{})
+		case OpDelete:
+			delete(t.kv.data, op.Key)
+			t.kv.rev++
+			responses = append(responses, OpResponse{})
+		case OpGet:
+			if v, exists := t.kv.data[op.Key]; exists {
+				responses = append(responses, OpResponse{Kvs: []KV{{Key: op.Key, Value: append([]byte(nil), v...)}}})
+			} else {
+				responses = append(responses, OpResponse{})
+			}
+		}
+	}
+
+	return &TxnResponse{Succeeded: ok, Responses: responses}, nil
+}
+
+func newTestStore(kv KVStore, compression Compression, minBytes int) *Store {
+	return &Store{kv: kv, compression: compression, compressionMinBytes: minBytes}
+}
+
+func TestCreateFirstClusterID_OnlyOneWins(t *testing.T) {
+	kv := newFakeKV()
+	s1 := newTestStore(kv, CompressionNone, 0)
+	s2 := newTestStore(kv, CompressionNone, 0)
+
+	id1, err := s1.CreateFirstClusterID()
+	if err != nil {
+		t.Fatalf("s1.CreateFirstClusterID: %v", err)
+	}
+
+	id2, err := s2.CreateFirstClusterID()
+	if err != nil {
+		t.Fatalf("s2.CreateFirstClusterID: %v", err)
+	}
+
+	if id1 != id2 {
+		t.Fatalf("expected both stores to agree on the bootstrapped cluster ID, got %d and %d", id1, id2)
+	}
+}
+
+func TestSetClusterBootstrapped_OnlyOneWins(t *testing.T) {
+	kv := newFakeKV()
+	s1 := newTestStore(kv, CompressionNone, 0)
+	s2 := newTestStore(kv, CompressionNone, 0)
+
+	cluster := metapb.Cluster{}
+	store := metapb.Store{ID: 1}
+	cell := metapb.Cell{ID: 1}
+
+	ok1, err := s1.SetClusterBootstrapped(1, cluster, store, cell)
+	if err != nil {
+		t.Fatalf("s1.SetClusterBootstrapped: %v", err)
+	}
+	if !ok1 {
+		t.Fatalf("expected the first SetClusterBootstrapped to succeed")
+	}
+
+	ok2, err := s2.SetClusterBootstrapped(1, cluster, store, cell)
+	if err != nil {
+		t.Fatalf("s2.SetClusterBootstrapped: %v", err)
+	}
+	if ok2 {
+		t.Fatalf("expected the second SetClusterBootstrapped to lose the race")
+	}
+}
+
+func TestCompressionRoundTrip(t *testing.T) {
+	payload := bytes.Repeat([]byte("elasticell"), 1024)
+
+	for _, c := range []Compression{CompressionNone, CompressionGzip, CompressionSnappy} {
+		s := newTestStore(nil, c, 16)
+
+		encoded := s.encode(payload)
+		decoded, err := s.decode(encoded)
+		if err != nil {
+			t.Fatalf("%s: decode: %v", c, err)
+		}
+		if !bytes.Equal(decoded, payload) {
+			t.Fatalf("%s: round trip mismatch", c)
+		}
+	}
+}
+
+func TestGetValueUpgradesLegacyValue(t *testing.T) {
+	kv := newFakeKV()
+	s := newTestStore(kv, CompressionGzip, 1)
+
+	const key = "/pd/cluster/legacy"
+	legacy := bytes.Repeat([]byte("a"), 64)
+	kv.data[key] = legacy
+
+	value, err := s.getValue(key)
+	if err != nil {
+		t.Fatalf("getValue: %v", err)
+	}
+	if !bytes.Equal(value, legacy) {
+		t.Fatalf("getValue returned %q, want %q", value, legacy)
+	}
+
+	if isLegacyValue(kv.data[key]) {
+		t.Fatalf("expected the legacy value to be rewritten in the new format")
+	}
+
+	// a second read must not clobber the now-current encoding.
+	rewritten := kv.data[key]
+	if _, err := s.getValue(key); err != nil {
+		t.Fatalf("getValue (second read): %v", err)
+	}
+	if !bytes.Equal(kv.data[key], rewritten) {
+		t.Fatalf("second read unexpectedly rewrote an already-current value")
+	}
+}
+
+func TestGetValueUpgradeLosesRaceToConcurrentWrite(t *testing.T) {
+	kv := newFakeKV()
+	s := newTestStore(kv, CompressionGzip, 1)
+
+	const key = "/pd/cluster/legacy-race"
+	legacy := bytes.Repeat([]byte("a"), 64)
+	kv.data[key] = legacy
+
+	raw, err := kv.Get(context.Background(), key)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+
+	value, err := s.decode(raw)
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+
+	// simulate a concurrent writer updating key between getValue's Get and
+	// its would-be rewrite.
+	if err := kv.Put(context.Background(), key, s.encode(bytes.Repeat([]byte("b"), 8))); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	concurrent := kv.data[key]
+
+	if err := s.rewriteLegacyValue(key, raw, value); err != nil {
+		t.Fatalf("rewriteLegacyValue: %v", err)
+	}
+
+	if !bytes.Equal(kv.data[key], concurrent) {
+		t.Fatalf("rewriteLegacyValue clobbered a concurrent write")
+	}
+}
+
+func TestMigratorRunAndVerify(t *testing.T) {
+	srcKV := newFakeKV()
+	dstKV := newFakeKV()
+	src := newTestStore(srcKV, CompressionNone, 0)
+	dst := newTestStore(dstKV, CompressionNone, 0)
+
+	const clusterID = 1
+	if _, err := src.SetClusterBootstrapped(clusterID, metapb.Cluster{}, metapb.Store{ID: 1}, metapb.Cell{ID: 1}); err != nil {
+		t.Fatalf("SetClusterBootstrapped: %v", err)
+	}
+	if err := src.SetStoreMeta(clusterID, metapb.Store{ID: 2}); err != nil {
+		t.Fatalf("SetStoreMeta: %v", err)
+	}
+	if err := src.SetCellMeta(clusterID, metapb.Cell{ID: 2}); err != nil {
+		t.Fatalf("SetCellMeta: %v", err)
+	}
+
+	m := NewMigrator(src, dst, clusterID, 10, nil)
+	if err := m.Run(); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if err := m.Verify(); err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+
+	checkpoint, err := m.Checkpoint()
+	if err != nil {
+		t.Fatalf("Checkpoint: %v", err)
+	}
+	if checkpoint != 2 {
+		t.Fatalf("checkpoint = %d, want 2", checkpoint)
+	}
+}
+
+func TestWatchStoresCompactionFallback(t *testing.T) {
+	kv := newFakeKV()
+	s := newTestStore(kv, CompressionNone, 0)
+
+	const clusterID = 1
+	if err := s.SetStoreMeta(clusterID, metapb.Store{ID: 1}); err != nil {
+		t.Fatalf("SetStoreMeta: %v", err)
+	}
+
+	prefix := s.getStoreMetaKey(clusterID, 0)
+
+	out, cancel, err := s.WatchStores(clusterID, 0)
+	if err != nil {
+		t.Fatalf("WatchStores: %v", err)
+	}
+	defer cancel()
+	kv.waitForWatcher(t, prefix)
+
+	if err := s.SetStoreMeta(clusterID, metapb.Store{ID: 2}); err != nil {
+		t.Fatalf("SetStoreMeta: %v", err)
+	}
+
+	evt := <-out
+	if evt.Type != EventTypePut || evt.Store.ID != 2 {
+		t.Fatalf("got %+v, want a put for store 2", evt)
+	}
+
+	kv.compact(prefix, errCompactionForTest)
+
+	evt = <-out
+	if evt.Type != EventTypePut {
+		t.Fatalf("expected the post-compaction snapshot to replay as puts, got %+v", evt)
+	}
+
+	seen := map[uint64]bool{evt.Store.ID: true}
+	evt, ok := <-out
+	if ok {
+		seen[evt.Store.ID] = true
+	}
+	if !seen[1] || !seen[2] {
+		t.Fatalf("expected the snapshot to replay both stores, got %v", seen)
+	}
+
+	kv.waitForWatcher(t, prefix)
+
+	if err := s.SetStoreMeta(clusterID, metapb.Store{ID: 3}); err != nil {
+		t.Fatalf("SetStoreMeta: %v", err)
+	}
+
+	evt = <-out
+	if evt.Store.ID != 3 {
+		t.Fatalf("expected the watch to resume live after the snapshot, got %+v", evt)
+	}
+
+	if err := s.kv.Delete(context.Background(), s.getStoreMetaKey(clusterID, 3)); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+
+	evt = <-out
+	if evt.Type != EventTypeDelete || evt.Store.ID != 3 {
+		t.Fatalf("expected a delete event carrying ID 3, got %+v", evt)
+	}
+}
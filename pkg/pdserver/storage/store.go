@@ -0,0 +1,173 @@
+// Copyright 2016 DeepFabric, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// DefaultTimeout is the timeout used for write operations (puts, txns).
+	DefaultTimeout = time.Second * 3
+	// DefaultRequestTimeout is the timeout used for read operations.
+	DefaultRequestTimeout = time.Second * 10
+
+	// pdClusterRootPath is the root of every cluster's metadata tree.
+	pdClusterRootPath = "/pd/cluster"
+	// pdClusterIDPath stores the cluster ID generated by the first PD to
+	// bootstrap.
+	pdClusterIDPath = pdClusterRootPath + "/id"
+	// pdLeaderPath is the sibling of pdClusterIDPath that stores the current
+	// PD leader.
+	pdLeaderPath = pdClusterRootPath + "/leader"
+)
+
+// Cfg configures which KVStore/Election backend a Store talks to, and how
+// it codes values on the wire.
+type Cfg struct {
+	// Backend selects the driver: etcdv3, etcdv2 or consul. Defaults to
+	// BackendEtcdV3 when empty.
+	Backend Backend
+	// Endpoints are the backend's client addresses.
+	Endpoints []string
+	// Compression selects the value codec. Defaults to CompressionNone.
+	Compression Compression
+	// CompressionMinBytes is the smallest value Store will compress; values
+	// below this are stored raw. Defaults to DefaultCompressionMinBytes
+	// when Compression is not CompressionNone and this is 0.
+	CompressionMinBytes int
+}
+
+// Store is PD's metadata store. It is backend-agnostic: all reads and
+// writes go through a KVStore, and leader election through an Election, so
+// the underlying cluster can be etcd v3, etcd v2 or Consul.
+type Store struct {
+	cfg                 Cfg
+	kv                  KVStore
+	election            Election
+	compression         Compression
+	compressionMinBytes int
+}
+
+// NewStore creates a Store backed by the driver selected in cfg.
+func NewStore(cfg Cfg) (*Store, error) {
+	kv, err := NewKVStore(cfg.Backend, cfg.Endpoints)
+	if err != nil {
+		return nil, err
+	}
+
+	election, err := NewElection(cfg.Backend, cfg.Endpoints, pdLeaderPath)
+	if err != nil {
+		kv.Close()
+		return nil, err
+	}
+
+	minBytes := cfg.CompressionMinBytes
+	if cfg.Compression != CompressionNone && cfg.Compression != "" && minBytes == 0 {
+		minBytes = DefaultCompressionMinBytes
+	}
+
+	return &Store{
+		cfg:                 cfg,
+		kv:                  kv,
+		election:            election,
+		compression:         cfg.Compression,
+		compressionMinBytes: minBytes,
+	}, nil
+}
+
+// Close releases the resources held by the underlying backend.
+func (s *Store) Close() error {
+	return s.kv.Close()
+}
+
+func (s *Store) getValue(key string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultRequestTimeout)
+	defer cancel()
+
+	raw, err := s.kv.Get(ctx, key)
+	if err != nil || raw == nil {
+		return raw, err
+	}
+
+	value, err := s.decode(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	// migration path: a key written before this Store had a compression
+	// codec carries no magic prefix at all. When compression is enabled,
+	// upgrade it to the current format on first read, guarded by a CAS on
+	// the exact bytes just read
+	// so a concurrent writer's update is never clobbered back to stale
+	// legacy data. If the rewrite fails, or loses the race, the key simply
+	// stays as-is until the next successful read.
+	if isLegacyValue(raw) && s.compression != CompressionNone && s.compression != "" {
+		_ = s.rewriteLegacyValue(key, raw, value)
+	}
+
+	return value, nil
+}
+
+// rewriteLegacyValue upgrades key from its legacy, magic-byte-free encoding
+// to the current one, but only if it still holds exactly raw - the bytes
+// getValue just read it as.
+func (s *Store) rewriteLegacyValue(key string, raw, value []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultTimeout)
+	defer cancel()
+
+	_, err := s.kv.Txn(ctx).
+		If(Cmp{Key: key, Target: CmpValue, Result: "=", Value: string(raw)}).
+		Then(Op{Type: OpPut, Key: key, Value: s.encode(value)}).
+		Commit()
+
+	return errors.Wrap(err, "")
+}
+
+func (s *Store) list(key, rangeEnd string, limit int64) ([]KV, error) {
+	kvs, _, err := s.listWithRev(key, rangeEnd, limit)
+	return kvs, err
+}
+
+// listWithRev is list plus the revision the read was taken at, so a Watch
+// can later resume from exactly this point with no race window.
+func (s *Store) listWithRev(key, rangeEnd string, limit int64) ([]KV, int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultRequestTimeout)
+	defer cancel()
+
+	kvs, rev, err := s.kv.ListWithRev(ctx, key, rangeEnd, limit)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	for i, item := range kvs {
+		value, err := s.decode(item.Value)
+		if err != nil {
+			return nil, 0, err
+		}
+		kvs[i].Value = value
+	}
+
+	return kvs, rev, nil
+}
+
+func (s *Store) save(key string, value []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultTimeout)
+	defer cancel()
+
+	return errors.Wrap(s.kv.Put(ctx, key, s.encode(value)), "")
+}
@@ -0,0 +1,238 @@
+// Copyright 2016 DeepFabric, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"context"
+	"strconv"
+	"strings"
+
+	"github.com/deepfabric/elasticell/pkg/pb/metapb"
+	"github.com/pkg/errors"
+)
+
+// idFromKey parses the trailing %020d ID segment off a store/cell meta key
+// (".../stores/%020d" or ".../cells/%020d"). A DELETE WatchEvent carries no
+// value on any backend - etcdv3 without WithPrevKV, etcdv2 and Consul never
+// at all - so the entity's ID can only be recovered from its key.
+func idFromKey(key string) (uint64, error) {
+	idx := strings.LastIndex(key, "/")
+	if idx < 0 {
+		return 0, errors.Errorf("storage: malformed meta key %q", key)
+	}
+
+	return strconv.ParseUint(key[idx+1:], 10, 64)
+}
+
+// StoreEvent is a single change to a store's metadata, delivered by
+// Store.WatchStores. On a DELETE, no backend carries the removed value, so
+// Store only has its ID populated; every other field is zero.
+type StoreEvent struct {
+	Type  EventType
+	Store metapb.Store
+}
+
+// CellEvent is a single change to a cell's metadata, delivered by
+// Store.WatchCells. On a DELETE, no backend carries the removed value, so
+// Cell only has its ID populated; every other field is zero.
+type CellEvent struct {
+	Type EventType
+	Cell metapb.Cell
+}
+
+// WatchStores streams changes to every store's metadata under clusterID,
+// starting at fromRev (<= 0 means watch from now). If the underlying
+// backend has compacted fromRev away, WatchStores transparently falls back
+// to a full LoadStoreMeta-equivalent snapshot and re-attaches the watch at
+// the snapshot's revision, so the caller's in-memory replica never sees a
+// gap. The returned channel is closed, and the CancelFunc becomes a no-op,
+// once the caller cancels or the backend closes the watch for good.
+func (s *Store) WatchStores(clusterID uint64, fromRev int64) (<-chan StoreEvent, CancelFunc, error) {
+	prefix := s.getStoreMetaKey(clusterID, 0)
+	rangeEnd := s.getStoreMetaKey(clusterID, endID)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	out := make(chan StoreEvent)
+
+	go s.watchStoresLoop(ctx, prefix, rangeEnd, fromRev, out)
+
+	return out, CancelFunc(cancel), nil
+}
+
+func (s *Store) watchStoresLoop(ctx context.Context, prefix, rangeEnd string, fromRev int64, out chan<- StoreEvent) {
+	defer close(out)
+
+	for {
+		events, cancelWatch, err := s.kv.Watch(ctx, prefix, rangeEnd, fromRev)
+		if err != nil {
+			return
+		}
+
+		compacted := false
+		for evt := range events {
+			if evt.Err != nil {
+				compacted = true
+				break
+			}
+
+			v := metapb.Store{}
+			if evt.Type == EventTypeDelete {
+				id, err := idFromKey(evt.KV.Key)
+				if err != nil {
+					continue
+				}
+				v.ID = id
+			} else {
+				value, err := s.decode(evt.KV.Value)
+				if err != nil {
+					continue
+				}
+				if v.Unmarshal(value) != nil {
+					continue
+				}
+			}
+
+			select {
+			case out <- StoreEvent{Type: evt.Type, Store: v}:
+			case <-ctx.Done():
+				cancelWatch()
+				return
+			}
+		}
+		cancelWatch()
+
+		if ctx.Err() != nil || !compacted {
+			return
+		}
+
+		rev, err := s.snapshotStores(ctx, prefix, rangeEnd, out)
+		if err != nil {
+			return
+		}
+		fromRev = rev + 1
+	}
+}
+
+func (s *Store) snapshotStores(ctx context.Context, prefix, rangeEnd string, out chan<- StoreEvent) (int64, error) {
+	kvs, rev, err := s.listWithRev(prefix, rangeEnd, 0)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, item := range kvs {
+		v := metapb.Store{}
+		if v.Unmarshal(item.Value) != nil {
+			continue
+		}
+
+		select {
+		case out <- StoreEvent{Type: EventTypePut, Store: v}:
+		case <-ctx.Done():
+			return rev, nil
+		}
+	}
+
+	return rev, nil
+}
+
+// WatchCells streams changes to every cell's metadata under clusterID, with
+// the same fromRev, compaction-fallback and resume semantics as
+// WatchStores.
+func (s *Store) WatchCells(clusterID uint64, fromRev int64) (<-chan CellEvent, CancelFunc, error) {
+	prefix := s.getCellMetaKey(clusterID, 0)
+	rangeEnd := s.getCellMetaKey(clusterID, endID)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	out := make(chan CellEvent)
+
+	go s.watchCellsLoop(ctx, prefix, rangeEnd, fromRev, out)
+
+	return out, CancelFunc(cancel), nil
+}
+
+func (s *Store) watchCellsLoop(ctx context.Context, prefix, rangeEnd string, fromRev int64, out chan<- CellEvent) {
+	defer close(out)
+
+	for {
+		events, cancelWatch, err := s.kv.Watch(ctx, prefix, rangeEnd, fromRev)
+		if err != nil {
+			return
+		}
+
+		compacted := false
+		for evt := range events {
+			if evt.Err != nil {
+				compacted = true
+				break
+			}
+
+			v := metapb.Cell{}
+			if evt.Type == EventTypeDelete {
+				id, err := idFromKey(evt.KV.Key)
+				if err != nil {
+					continue
+				}
+				v.ID = id
+			} else {
+				value, err := s.decode(evt.KV.Value)
+				if err != nil {
+					continue
+				}
+				if v.Unmarshal(value) != nil {
+					continue
+				}
+			}
+
+			select {
+			case out <- CellEvent{Type: evt.Type, Cell: v}:
+			case <-ctx.Done():
+				cancelWatch()
+				return
+			}
+		}
+		cancelWatch()
+
+		if ctx.Err() != nil || !compacted {
+			return
+		}
+
+		rev, err := s.snapshotCells(ctx, prefix, rangeEnd, out)
+		if err != nil {
+			return
+		}
+		fromRev = rev + 1
+	}
+}
+
+func (s *Store) snapshotCells(ctx context.Context, prefix, rangeEnd string, out chan<- CellEvent) (int64, error) {
+	kvs, rev, err := s.listWithRev(prefix, rangeEnd, 0)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, item := range kvs {
+		v := metapb.Cell{}
+		if v.Unmarshal(item.Value) != nil {
+			continue
+		}
+
+		select {
+		case out <- CellEvent{Type: EventTypePut, Cell: v}:
+		case <-ctx.Done():
+			return rev, nil
+		}
+	}
+
+	return rev, nil
+}